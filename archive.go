@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// archiveFormat is the type of the created archive.
+type archiveFormat string
+
+const (
+	formatZIP    archiveFormat = "zip"
+	formatTar    archiveFormat = "tar"
+	formatTarGz  archiveFormat = "tar.gz"
+	formatTarZst archiveFormat = "tar.zst"
+	formatTarXz  archiveFormat = "tar.xz"
+)
+
+func parseArchiveFormat(format string) (archiveFormat, error) {
+	switch f := archiveFormat(strings.ToLower(format)); f {
+	case formatZIP, formatTar, formatTarGz, formatTarZst, formatTarXz:
+		return f, nil
+	case "":
+		return formatZIP, nil
+	default:
+		return "", fmt.Errorf("unsupported archive format (%s)", format)
+	}
+}
+
+// extension returns the file extension of the format, including the leading dot.
+func (f archiveFormat) extension() string {
+	return "." + string(f)
+}
+
+// archiveOptions configures how the archive is written.
+type archiveOptions struct {
+	format archiveFormat
+	levels compressionLevels
+	// appendTo keeps the entries of the archive already existing at the destination,
+	// unless an entry with the same name is added.
+	appendTo bool
+	// checksums lists the algorithms used to compute the digests of the archive.
+	checksums []string
+	// manifestFormat is the format of the manifest listing the entries (json or csv), empty if no manifest is created.
+	manifestFormat string
+	// manifestName is the name of the manifest in the archive.
+	manifestName string
+	// reproducible makes the archive byte-identical for identical inputs, every entry gets modTime as its modification time.
+	reproducible bool
+	modTime      time.Time
+	// splitSize is the maximum size of a part in bytes, larger archives are split according to splitMode.
+	// Zero disables splitting.
+	splitSize int64
+	splitMode splitMode
+	// parallelism is the number of ZIP entries compressed concurrently.
+	parallelism int
+	// encryption is the method used to encrypt the ZIP entries with password, encryptionNone if the entries are not encrypted.
+	encryption zipEncryption
+	password   string
+	// zip64 controls when the ZIP64 records are used in a ZIP archive.
+	zip64 zip64Mode
+	// unixMetadata controls how the Unix permissions, owner and timestamps of the files are stored.
+	unixMetadata unixMetadata
+	// progressInterval is the time between the progress lines logged while the archive is written, zero disables them.
+	progressInterval time.Duration
+}
+
+// archiveResult describes the created archive.
+type archiveResult struct {
+	entries      int
+	checksums    []*checksum
+	manifest     []byte
+	manifestPath string
+	// parts lists the files of the archive, if it is split.
+	parts []archivePart
+	// s3URLs lists the URLs of the uploaded archive or parts, if it is uploaded to S3.
+	s3URLs []string
+	// uploadResponse is the response body of the HTTP upload, if the archive is uploaded to an HTTP endpoint.
+	uploadResponse *string
+}
+
+// archiveWriter writes entries to an archive of a specific format.
+type archiveWriter interface {
+	// prepare is called with the entries before they are added, so the writer can process them ahead.
+	prepare(entries []archiveEntry) error
+	// add writes a single file, directory or symlink to the archive.
+	// It returns the manifest record of the entry, or nil if the entry was skipped.
+	add(entry archiveEntry) (*manifestRecord, error)
+	// addData writes a regular file with the given content to the archive.
+	addData(name string, data []byte, modTime time.Time) error
+	// copyFrom copies the entries of an existing archive of the same format, except the ones listed in skip.
+	// It returns the manifest records of the copied entries.
+	copyFrom(pth string, format archiveFormat, skip map[string]bool) ([]manifestRecord, error)
+	// close flushes the archive, the underlying file is closed by the caller.
+	close() error
+}
+
+// writeArchive creates an archive of the given format at destination from the entries
+// and tests the integrity of the result.
+// The archive is written to a temporary file next to the destination, which is moved in place
+// only if the archive is complete, so an interrupted run never leaves a partial archive behind.
+// The checksums of the archive are computed while it is written and stored next to it, just like the manifest.
+func writeArchive(entries []archiveEntry, destination string, opts archiveOptions) (archiveResult, error) {
+	tmpPth, err := createTempFileNextTo(destination)
+	if err != nil {
+		return archiveResult{}, err
+	}
+	temps := &tempFiles{}
+	temps.add(tmpPth)
+	stopWatching := removeOnSignal(temps)
+	defer stopWatching()
+
+	base := ""
+	if opts.appendTo {
+		base = destination
+	}
+
+	result, err := createArchive(entries, tmpPth, base, opts, temps)
+	if err == nil {
+		result, err = moveArchiveInPlace(tmpPth, destination, result, opts, temps)
+	}
+	if err != nil {
+		removeTempFile(tmpPth)
+		return archiveResult{}, err
+	}
+
+	// A split ZIP archive can not be reassembled into the original one, so every volume gets its own checksum.
+	checksummed := []archivePart{{pth: destination, checksums: result.checksums}}
+	if opts.splitMode == splitZIP && len(result.parts) > 0 {
+		checksummed = result.parts
+	}
+	for i, c := range result.checksums {
+		var digests []fileDigest
+		for _, part := range checksummed {
+			digests = append(digests, fileDigest{name: filepath.Base(part.pth), digest: part.checksums[i].digest()})
+		}
+		pth, err := writeChecksumFile(destination, c.algorithm, digests)
+		if err != nil {
+			return archiveResult{}, fmt.Errorf("failed to write %s checksum: %s", c.algorithm, err)
+		}
+		log.Printf("%s checksum written to %s", c.algorithm, pth)
+	}
+
+	if opts.manifestFormat != "" {
+		pth, err := writeManifestFile(destination, result.manifest, opts.manifestFormat)
+		if err != nil {
+			return archiveResult{}, fmt.Errorf("failed to write manifest: %s", err)
+		}
+		result.manifestPath = pth
+		log.Printf("Manifest written to %s", pth)
+	}
+
+	return result, nil
+}
+
+// moveArchiveInPlace moves the complete archive to destination, or splits it into parts next to destination
+// if it is larger than the split size.
+func moveArchiveInPlace(tmpPth, destination string, result archiveResult, opts archiveOptions, temps *tempFiles) (archiveResult, error) {
+	info, err := os.Stat(tmpPth)
+	if err != nil {
+		return archiveResult{}, err
+	}
+	if opts.splitSize == 0 || info.Size() <= opts.splitSize {
+		if opts.splitSize > 0 {
+			// The parts of an overwritten split archive would be left behind next to the new archive.
+			if err := removeParts(destination, opts.splitMode); err != nil {
+				return archiveResult{}, fmt.Errorf("failed to remove the parts of the existing archive: %s", err)
+			}
+		}
+		return result, os.Rename(tmpPth, destination)
+	}
+
+	if result.parts, err = splitArchive(tmpPth, destination, opts, temps); err != nil {
+		return archiveResult{}, fmt.Errorf("failed to split archive: %s", err)
+	}
+	removeTempFile(tmpPth)
+	log.Printf("The archive is split into %d parts", len(result.parts))
+
+	if opts.splitMode == splitZIP {
+		// The outputs describe the .zip volume.
+		result.checksums = result.parts[len(result.parts)-1].checksums
+	}
+	return result, nil
+}
+
+// createTempFileNextTo creates an empty hidden file in the directory of pth and returns its path.
+// Unlike os.CreateTemp, the file is created with the same permissions as os.Create would use.
+func createTempFileNextTo(pth string) (string, error) {
+	for i := 0; ; i++ {
+		tmpPth := filepath.Join(filepath.Dir(pth), fmt.Sprintf(".%s.%d-%d.tmp", filepath.Base(pth), os.Getpid(), i))
+		f, err := os.OpenFile(tmpPth, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return tmpPth, f.Close()
+	}
+}
+
+func removeTempFile(pth string) {
+	if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove %s: %s", pth, err)
+	}
+}
+
+// tempFiles lists the temporary files to remove if the step is interrupted.
+type tempFiles struct {
+	mu   sync.Mutex
+	pths []string
+}
+
+func (t *tempFiles) add(pth string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pths = append(t.pths, pth)
+}
+
+func (t *tempFiles) removeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, pth := range t.pths {
+		removeTempFile(pth)
+	}
+}
+
+// removeOnSignal removes the temporary files and exits if the step is interrupted or terminated.
+// The returned function stops watching the signals.
+func removeOnSignal(temps *tempFiles) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			temps.removeAll()
+			failf("Interrupted (%s), the partial archive is removed", sig)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// createArchive writes the archive to pth. If base is not empty, the entries of the base archive are copied first.
+// The temporary files used while writing the archive are registered in temps.
+func createArchive(entries []archiveEntry, pth, base string, opts archiveOptions, temps *tempFiles) (archiveResult, error) {
+	f, err := os.Create(pth)
+	if err != nil {
+		return archiveResult{}, err
+	}
+	closeFile := func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}
+
+	progress := newProgressReporter(entries, opts.progressInterval)
+	checksums := newChecksums(opts.checksums)
+	writers := []io.Writer{progress.archiveWriter(f)}
+	for _, c := range checksums {
+		writers = append(writers, c.hash)
+	}
+	out := io.MultiWriter(writers...)
+
+	var w archiveWriter
+	if opts.format == formatZIP {
+		w = newZIPArchive(out, opts, temps, progress)
+	} else if w, err = newTarArchive(out, opts, progress); err != nil {
+		closeFile()
+		return archiveResult{}, err
+	}
+	abort := func(err error) (archiveResult, error) {
+		progress.finish(false)
+		if cerr := w.close(); cerr != nil {
+			log.Warnf("Failed to close archive: %s", cerr)
+		}
+		closeFile()
+		return archiveResult{}, err
+	}
+
+	progress.start()
+	if err := w.prepare(entries); err != nil {
+		return abort(err)
+	}
+
+	var records []manifestRecord
+	if base != "" {
+		replaced := map[string]bool{}
+		for _, entry := range entries {
+			replaced[entry.name] = true
+		}
+		if opts.manifestName != "" {
+			replaced[opts.manifestName] = true
+		}
+
+		copied, err := w.copyFrom(base, opts.format, replaced)
+		if err != nil {
+			return abort(err)
+		}
+		records = append(records, copied...)
+	}
+
+	for _, entry := range entries {
+		record, err := w.add(entry)
+		if err != nil {
+			return abort(fmt.Errorf("failed to add %s: %s", entry.pth, err))
+		}
+		progress.entryDone()
+		if record != nil {
+			records = append(records, *record)
+		}
+	}
+
+	result := archiveResult{entries: len(records), checksums: checksums}
+	if opts.manifestFormat != "" {
+		if result.manifest, err = encodeManifest(records, opts.manifestFormat); err != nil {
+			return abort(fmt.Errorf("failed to encode manifest: %s", err))
+		}
+		modTime := time.Now()
+		if opts.reproducible {
+			modTime = opts.modTime
+		}
+		if err := w.addData(opts.manifestName, result.manifest, modTime); err != nil {
+			return abort(fmt.Errorf("failed to add manifest: %s", err))
+		}
+		result.entries++
+	}
+
+	if err := w.close(); err != nil {
+		progress.finish(false)
+		closeFile()
+		return archiveResult{}, err
+	}
+	progress.finish(true)
+
+	if err := f.Close(); err != nil {
+		return archiveResult{}, err
+	}
+
+	if err := testArchive(pth, opts.format, opts.password); err != nil {
+		return archiveResult{}, err
+	}
+
+	return result, nil
+}
+
+// testArchive reads back every entry of the archive to check its integrity.
+// The password is used to decrypt the encrypted ZIP entries.
+func testArchive(pth string, format archiveFormat, password string) error {
+	if format == formatZIP {
+		return testZIP(pth, password)
+	}
+	return testTar(pth, format)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/bitrise-tools/go-steputils/stepconf"
+	"gopkg.in/yaml.v2"
+)
+
+// archiveJob is an archive to create in batch mode. Its inputs override the inputs of the Step.
+type archiveJob struct {
+	name   string
+	inputs map[string]string
+}
+
+// jobResult is the outcome of an archive job, exported as a part of BITRISE_ZIP_BATCH_RESULTS.
+type jobResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Path       string  `json:"path,omitempty"`
+	Size       int64   `json:"size,omitempty"`
+	EntryCount int     `json:"entry_count,omitempty"`
+	S3URL      string  `json:"s3_url,omitempty"`
+	Duration   float64 `json:"duration_seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+const (
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobDryRun    = "dry run"
+)
+
+// parseArchiveJobs parses the YAML or JSON list of archive jobs.
+// Every job is a map of Step input names to values, a list value is joined by newlines.
+// The optional name key names the job in the log and in the results.
+func parseArchiveJobs(spec string) ([]archiveJob, error) {
+	var items []map[string]interface{}
+	if err := yaml.Unmarshal([]byte(spec), &items); err != nil {
+		return nil, fmt.Errorf("invalid archives spec: %s", err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no archive defined in the archives spec")
+	}
+
+	known := configInputs()
+	var jobs []archiveJob
+	for i, item := range items {
+		job := archiveJob{name: fmt.Sprintf("archive-%d", i+1), inputs: map[string]string{}}
+		for key, value := range item {
+			str, err := jobInputValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of archive %d: %s", key, i+1, err)
+			}
+
+			switch {
+			case key == "name":
+				job.name = str
+			case key == "archives" || !known[key]:
+				return nil, fmt.Errorf("unknown input (%s) in archive %d", key, i+1)
+			case key == "mode" && str != "create":
+				return nil, fmt.Errorf("archive %d: only the create mode is supported in batch mode", i+1)
+			default:
+				job.inputs[key] = str
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// jobInputValue converts a YAML value to the string form of a Step input.
+func jobInputValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		if v {
+			return "yes", nil
+		}
+		return "no", nil
+	case int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			str, err := jobInputValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, str)
+		}
+		return strings.Join(items, "\n"), nil
+	default:
+		return "", fmt.Errorf("unsupported value (%v)", value)
+	}
+}
+
+// configInputs returns the names of the Step inputs.
+func configInputs() map[string]bool {
+	inputs := map[string]bool{}
+	t := reflect.TypeOf(config{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag, ok := t.Field(i).Tag.Lookup("env"); ok {
+			inputs[strings.Split(tag, ",")[0]] = true
+		}
+	}
+	return inputs
+}
+
+// config parses the inputs of the Step, overridden by the inputs of the job.
+func (j archiveJob) config() (config, error) {
+	previous := map[string]*string{}
+	defer func() {
+		for key, value := range previous {
+			var err error
+			if value == nil {
+				err = os.Unsetenv(key)
+			} else {
+				err = os.Setenv(key, *value)
+			}
+			if err != nil {
+				log.Warnf("Failed to restore %s: %s", key, err)
+			}
+		}
+	}()
+
+	for key, value := range j.inputs {
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return config{}, err
+		}
+	}
+
+	var cfg config
+	if err := stepconf.Parse(&cfg); err != nil {
+		return config{}, err
+	}
+	cfg.Archives = ""
+	return cfg, nil
+}
+
+// runBatch creates every archive of the spec, even if some of them fail,
+// then prints a summary and exports the results. It returns an error listing the failed archives.
+func runBatch(spec string) error {
+	jobs, err := parseArchiveJobs(spec)
+	if err != nil {
+		return err
+	}
+
+	var results []jobResult
+	for i, job := range jobs {
+		log.Printf("")
+		log.Infof("Archive %d/%d: %s", i+1, len(jobs), job.name)
+
+		started := time.Now()
+		result, err := runJob(job)
+		result.Name = job.name
+		result.Duration = time.Since(started).Seconds()
+		if err != nil {
+			log.Errorf("Failed to create %s: %s", job.name, err)
+			result.Status = jobFailed
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	log.Printf("")
+	log.Infof("Summary")
+
+	var failures []string
+	var pths []string
+	for _, result := range results {
+		duration := time.Duration(result.Duration * float64(time.Second)).Round(time.Millisecond)
+		switch result.Status {
+		case jobSucceeded:
+			log.Donef("%s: %s (%s, %d entries) in %s", result.Name, result.Path, formatBytes(result.Size), result.EntryCount, duration)
+			pths = append(pths, result.Path)
+		case jobDryRun:
+			log.Printf("%s: dry run, nothing was written", result.Name)
+		default:
+			log.Errorf("%s: failed in %s", result.Name, duration)
+			failures = append(failures, fmt.Sprintf("- %s: %s", result.Name, result.Error))
+		}
+	}
+	log.Printf("%d archives, %d succeeded, %d failed", len(results), len(pths), len(failures))
+
+	if err := exportBatchOutputs(results, pths); err != nil {
+		return fmt.Errorf("failed to export outputs: %s", err)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d archives failed:\n%s", len(failures), len(results), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+func runJob(job archiveJob) (jobResult, error) {
+	cfg, err := job.config()
+	if err != nil {
+		return jobResult{}, err
+	}
+	stepconf.Print(cfg)
+
+	destination, result, err := create(cfg)
+	if err != nil {
+		return jobResult{}, err
+	}
+	if cfg.DryRun {
+		return jobResult{Status: jobDryRun}, nil
+	}
+
+	pth, err := filepath.Abs(destination)
+	if err != nil {
+		return jobResult{}, err
+	}
+	size, err := archiveSize(pth, result)
+	if err != nil {
+		return jobResult{}, err
+	}
+	return jobResult{Status: jobSucceeded, Path: pth, Size: size, EntryCount: result.entries, S3URL: strings.Join(result.s3URLs, "|")}, nil
+}
+
+// exportBatchOutputs exports the results of every job as JSON and the paths of the created archives.
+func exportBatchOutputs(results []jobResult, pths []string) error {
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("")
+	log.Infof("Exporting outputs")
+
+	for _, output := range []struct{ key, value string }{
+		{"BITRISE_ZIP_BATCH_RESULTS", string(data)},
+		{"BITRISE_ZIP_BATCH_PATHS", strings.Join(pths, "|")},
+	} {
+		if err := exportEnvironmentWithEnvman(output.key, output.value); err != nil {
+			return fmt.Errorf("failed to export %s: %s", output.key, err)
+		}
+		log.Donef("$%s = %s", output.key, output.value)
+	}
+	return nil
+}
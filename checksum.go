@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksum is the digest of the archive computed by a specific algorithm.
+type checksum struct {
+	algorithm string
+	hash      hash.Hash
+}
+
+func parseChecksumAlgorithms(algorithms []string) ([]string, error) {
+	var parsed []string
+	seen := map[string]bool{}
+	for _, algorithm := range algorithms {
+		algorithm = strings.Replace(strings.ToLower(algorithm), "-", "", -1)
+		if _, ok := checksumAlgorithms[algorithm]; !ok {
+			return nil, fmt.Errorf("unsupported checksum algorithm (%s), supported algorithms: md5, sha1, sha256, sha512", algorithm)
+		}
+		if !seen[algorithm] {
+			seen[algorithm] = true
+			parsed = append(parsed, algorithm)
+		}
+	}
+	return parsed, nil
+}
+
+func newChecksums(algorithms []string) []*checksum {
+	var checksums []*checksum
+	for _, algorithm := range algorithms {
+		checksums = append(checksums, &checksum{algorithm: algorithm, hash: checksumAlgorithms[algorithm]()})
+	}
+	return checksums
+}
+
+func (c *checksum) digest() string {
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// outputKey returns the step output exporting the digest, for example BITRISE_ZIP_SHA256.
+func (c *checksum) outputKey() string {
+	return "BITRISE_ZIP_" + strings.ToUpper(c.algorithm)
+}
+
+// fileDigest is the digest of a file listed in a checksum file.
+type fileDigest struct {
+	name   string
+	digest string
+}
+
+// writeChecksumFile writes the digests next to the archive in the format of the sha256sum like tools,
+// so it can be verified with `sha256sum -c name.zip.sha256`. It returns the path of the written file.
+func writeChecksumFile(archivePth, algorithm string, digests []fileDigest) (string, error) {
+	pth := archivePth + "." + algorithm
+	var content strings.Builder
+	for _, d := range digests {
+		content.WriteString(fmt.Sprintf("%s  %s\n", d.digest, d.name))
+	}
+	if err := os.WriteFile(pth, []byte(content.String()), 0644); err != nil {
+		return "", err
+	}
+	return pth, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// compressionLevels holds the compression level of the archive and its per extension overrides.
+// Level 0 means the entries are stored without compression, 9 is the best compression.
+type compressionLevels struct {
+	level           int
+	extensionLevels map[string]int
+}
+
+// parseCompressionLevels validates the level and parses the overrides,
+// each override is a comma separated list of extensions and a level separated by `=`, for example: `.png,.jpg,.ipa=0`.
+func parseCompressionLevels(level int, overrides []string) (compressionLevels, error) {
+	if err := validateCompressionLevel(level); err != nil {
+		return compressionLevels{}, err
+	}
+
+	levels := compressionLevels{level: level, extensionLevels: map[string]int{}}
+	for _, override := range overrides {
+		idx := strings.LastIndex(override, "=")
+		if idx == -1 {
+			return compressionLevels{}, fmt.Errorf("invalid compression level override (%s): expected format is .ext1,.ext2=level", override)
+		}
+
+		extensionLevel, err := strconv.Atoi(strings.TrimSpace(override[idx+1:]))
+		if err != nil {
+			return compressionLevels{}, fmt.Errorf("invalid compression level override (%s): %s", override, err)
+		}
+		if err := validateCompressionLevel(extensionLevel); err != nil {
+			return compressionLevels{}, fmt.Errorf("invalid compression level override (%s): %s", override, err)
+		}
+
+		for _, ext := range strings.Split(override[:idx], ",") {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			levels.extensionLevels[ext] = extensionLevel
+		}
+	}
+
+	return levels, nil
+}
+
+func validateCompressionLevel(level int) error {
+	if level < 0 || level > 9 {
+		return fmt.Errorf("compression level (%d) should be between 0 and 9", level)
+	}
+	return nil
+}
+
+// levelFor returns the compression level of the entry with the given name.
+func (l compressionLevels) levelFor(name string) int {
+	if level, ok := l.extensionLevels[strings.ToLower(path.Ext(name))]; ok {
+		return level
+	}
+	return l.level
+}
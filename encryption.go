@@ -0,0 +1,585 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// zipEncryption is the method used to encrypt the ZIP entries.
+type zipEncryption string
+
+const (
+	encryptionNone      zipEncryption = ""
+	encryptionAES256    zipEncryption = "aes256"
+	encryptionZipCrypto zipEncryption = "zipcrypto"
+)
+
+const (
+	// aesMethod is the compression method of the WinZip AES encrypted entries,
+	// the actual compression method is stored in the AES extra field.
+	aesMethod           = 99
+	aesExtraID          = 0x9901
+	aesVendorVersionAE2 = 2
+	aesStrength256      = 3
+	aesKeyLength        = 32
+	aesSaltLength       = 16
+	aesVerifierLength   = 2
+	aesAuthCodeLength   = 10
+	aesIterations       = 1000
+
+	zipCryptoHeaderLength = 12
+
+	flagEncrypted      = 0x1
+	flagDataDescriptor = 0x8
+	flagUTF8           = 0x800
+
+	zipVersion20  = 20
+	zipVersion45  = 45
+	zipVersionAES = 51
+
+	extTimeExtraID = 0x5455
+)
+
+// errWrongPassword is returned if an encrypted entry can not be decrypted with the given password.
+var errWrongPassword = errors.New("wrong password")
+
+// parseZIPEncryption returns the encryption method used if a password is set.
+// ZipCrypto is weak, so it is used only if it is explicitly selected.
+func parseZIPEncryption(password, method string) (zipEncryption, error) {
+	if password == "" {
+		return encryptionNone, nil
+	}
+
+	switch encryption := zipEncryption(method); encryption {
+	case encryptionAES256, encryptionZipCrypto:
+		return encryption, nil
+	default:
+		return encryptionNone, fmt.Errorf("unsupported encryption method (%s)", method)
+	}
+}
+
+// writeEncryptedZIPEntry compresses and encrypts the content written by fn and writes it as a raw ZIP entry.
+// The sizes and the checksum are not known in advance, so they are stored in a data descriptor after the content.
+func writeEncryptedZIPEntry(zw *zip.Writer, header *zip.FileHeader, level int, password string, encryption zipEncryption, fn func(w io.Writer) error) error {
+	method := prepareRawZIPHeader(header, level, encryption)
+	raw, err := zw.CreateRaw(header)
+	if err != nil {
+		return err
+	}
+	// CreateRaw keeps the header, the data descriptor and the central directory are written from it later.
+	return encodeZIPEntry(raw, header, method, level, password, encryption, fn)
+}
+
+// prepareRawZIPHeader sets the fields of the header which CreateHeader would set, so an entry written by CreateRaw
+// is identical to the one written by CreateHeader, then the fields of the encryption, if any.
+// It returns the compression method of the content.
+func prepareRawZIPHeader(header *zip.FileHeader, level int, encryption zipEncryption) uint16 {
+	method := zip.Store
+	if level > 0 {
+		method = zip.Deflate
+	}
+
+	if requiresUTF8Flag(header.Name) {
+		header.Flags |= flagUTF8
+	}
+	header.Flags |= flagDataDescriptor
+	header.ReaderVersion = zipVersion20
+	if !header.Modified.IsZero() {
+		header.ModifiedDate, header.ModifiedTime = msDOSDateTime(header.Modified)
+		header.Extra = append(header.Extra, extendedTimestampExtra(header.Modified)...)
+	}
+
+	switch encryption {
+	case encryptionAES256:
+		header.Flags |= flagEncrypted
+		header.Method = aesMethod
+		header.Extra = append(header.Extra, aesExtra(method)...)
+		header.ReaderVersion = zipVersionAES
+	case encryptionZipCrypto:
+		header.Flags |= flagEncrypted
+		header.Method = method
+	default:
+		header.Method = method
+	}
+	header.CreatorVersion = header.CreatorVersion&0xff00 | header.ReaderVersion
+	return method
+}
+
+// encodeZIPEntry compresses and encrypts, if enabled, the content written by fn to out,
+// then sets the sizes and the checksum of the header.
+func encodeZIPEntry(out io.Writer, header *zip.FileHeader, method uint16, level int, password string, encryption zipEncryption, fn func(w io.Writer) error) error {
+	counter := &countingWriter{w: out}
+
+	var encrypter io.WriteCloser = nopWriteCloser{counter}
+	var err error
+	switch encryption {
+	case encryptionAES256:
+		encrypter, err = newAESEncrypter(counter, password)
+	case encryptionZipCrypto:
+		// With a data descriptor the high byte of the modification time is used to check the password.
+		encrypter, err = newZipCryptoEncrypter(counter, password, byte(header.ModifiedTime>>8))
+	}
+	if err != nil {
+		return err
+	}
+
+	var compressor io.WriteCloser = nopWriteCloser{encrypter}
+	if method == zip.Deflate {
+		if compressor, err = flate.NewWriter(encrypter, level); err != nil {
+			return err
+		}
+	}
+
+	checksum := crc32.NewIEEE()
+	content := &countingWriter{w: io.MultiWriter(compressor, checksum)}
+	if err := fn(content); err != nil {
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	if err := encrypter.Close(); err != nil {
+		return err
+	}
+
+	header.UncompressedSize64 = uint64(content.count)
+	header.CompressedSize64 = uint64(counter.count)
+	header.UncompressedSize = uint32(min(header.UncompressedSize64, uint32max))
+	header.CompressedSize = uint32(min(header.CompressedSize64, uint32max))
+	if header.UncompressedSize == uint32max || header.CompressedSize == uint32max {
+		header.ReaderVersion = max(header.ReaderVersion, zipVersion45)
+	}
+	// AE-2 entries store no CRC, the authentication code protects the content instead.
+	if encryption != encryptionAES256 {
+		header.CRC32 = checksum.Sum32()
+	}
+	return nil
+}
+
+const uint32max = (1 << 32) - 1
+
+// requiresUTF8Flag reports whether the name has to be flagged as UTF-8, using the same rules as CreateHeader:
+// the names which are not compatible with CP-437 and are valid UTF-8.
+func requiresUTF8Flag(name string) bool {
+	require := false
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		i += size
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			if r == utf8.RuneError && size == 1 {
+				return false
+			}
+			require = true
+		}
+	}
+	return require
+}
+
+func aesExtra(method uint16) []byte {
+	buf := make([]byte, 11)
+	binary.LittleEndian.PutUint16(buf[0:], aesExtraID)
+	binary.LittleEndian.PutUint16(buf[2:], 7)
+	binary.LittleEndian.PutUint16(buf[4:], aesVendorVersionAE2)
+	copy(buf[6:], "AE")
+	buf[8] = aesStrength256
+	binary.LittleEndian.PutUint16(buf[9:], method)
+	return buf
+}
+
+func extendedTimestampExtra(modTime time.Time) []byte {
+	buf := make([]byte, 9)
+	binary.LittleEndian.PutUint16(buf[0:], extTimeExtraID)
+	binary.LittleEndian.PutUint16(buf[2:], 5)
+	buf[4] = 1
+	binary.LittleEndian.PutUint32(buf[5:], uint32(modTime.Unix()))
+	return buf
+}
+
+// parseAESExtra returns the actual compression method of a WinZip AES encrypted entry.
+func parseAESExtra(extra []byte) (uint16, error) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id == aesExtraID && size == 7 {
+			if extra[8] != aesStrength256 {
+				return 0, fmt.Errorf("unsupported AES strength (%d)", extra[8])
+			}
+			return binary.LittleEndian.Uint16(extra[9:]), nil
+		}
+		extra = extra[4+size:]
+	}
+	return 0, errors.New("missing AES extra field")
+}
+
+// aesKeys derives the encryption key, the authentication key and the password verifier from the password.
+func aesKeys(password string, salt []byte) ([]byte, []byte, []byte) {
+	key := pbkdf2.Key([]byte(password), salt, aesIterations, 2*aesKeyLength+aesVerifierLength, sha1.New)
+	return key[:aesKeyLength], key[aesKeyLength : 2*aesKeyLength], key[2*aesKeyLength:]
+}
+
+// winZipCTR is the AES counter mode used by WinZip: the counter is little-endian and starts at 1.
+type winZipCTR struct {
+	block     cipher.Block
+	counter   [aes.BlockSize]byte
+	keyStream [aes.BlockSize]byte
+	pos       int
+}
+
+func newWinZipCTR(key []byte) (*winZipCTR, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &winZipCTR{block: block, pos: aes.BlockSize}, nil
+}
+
+func (c *winZipCTR) xorKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.pos == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.keyStream[:], c.counter[:])
+			c.pos = 0
+		}
+		dst[i] = src[i] ^ c.keyStream[c.pos]
+		c.pos++
+	}
+}
+
+// aesEncrypter writes the salt and the password verifier, then the encrypted content,
+// and the authentication code when it is closed.
+type aesEncrypter struct {
+	w   io.Writer
+	ctr *winZipCTR
+	mac hash.Hash
+	buf []byte
+}
+
+func newAESEncrypter(w io.Writer, password string) (*aesEncrypter, error) {
+	salt := make([]byte, aesSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, authKey, verifier := aesKeys(password, salt)
+	ctr, err := newWinZipCTR(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(verifier); err != nil {
+		return nil, err
+	}
+
+	return &aesEncrypter{w: w, ctr: ctr, mac: hmac.New(sha1.New, authKey)}, nil
+}
+
+func (e *aesEncrypter) Write(p []byte) (int, error) {
+	if cap(e.buf) < len(p) {
+		e.buf = make([]byte, len(p))
+	}
+	buf := e.buf[:len(p)]
+	e.ctr.xorKeyStream(buf, p)
+	e.mac.Write(buf)
+	return e.w.Write(buf)
+}
+
+func (e *aesEncrypter) Close() error {
+	_, err := e.w.Write(e.mac.Sum(nil)[:aesAuthCodeLength])
+	return err
+}
+
+// aesDecrypter decrypts the content following the salt and the password verifier.
+// The authentication code is checked by verify, once the whole content is read.
+type aesDecrypter struct {
+	r        io.Reader
+	raw      io.Reader
+	ctr      *winZipCTR
+	mac      hash.Hash
+	verified bool
+}
+
+func newAESDecrypter(raw io.Reader, compressedSize int64, password string) (*aesDecrypter, error) {
+	header := make([]byte, aesSaltLength+aesVerifierLength)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		return nil, err
+	}
+	salt, expectedVerifier := header[:aesSaltLength], header[aesSaltLength:]
+
+	key, authKey, verifier := aesKeys(password, salt)
+	if subtle.ConstantTimeCompare(verifier, expectedVerifier) != 1 {
+		return nil, errWrongPassword
+	}
+
+	dataSize := compressedSize - int64(len(header)) - aesAuthCodeLength
+	if dataSize < 0 {
+		return nil, errors.New("invalid encrypted entry size")
+	}
+
+	ctr, err := newWinZipCTR(key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, authKey)
+	return &aesDecrypter{r: io.TeeReader(io.LimitReader(raw, dataSize), mac), raw: raw, ctr: ctr, mac: mac}, nil
+}
+
+func (d *aesDecrypter) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.ctr.xorKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// verify reads the rest of the encrypted content and compares the authentication code.
+func (d *aesDecrypter) verify() error {
+	if d.verified {
+		return nil
+	}
+	d.verified = true
+
+	if _, err := io.Copy(d.mac, d.r); err != nil {
+		return err
+	}
+	authCode := make([]byte, aesAuthCodeLength)
+	if _, err := io.ReadFull(d.raw, authCode); err != nil {
+		return err
+	}
+	if !hmac.Equal(d.mac.Sum(nil)[:aesAuthCodeLength], authCode) {
+		return errors.New("authentication code mismatch, the entry is corrupt")
+	}
+	return nil
+}
+
+// zipCryptoKeys is the state of the traditional PKWARE encryption.
+type zipCryptoKeys [3]uint32
+
+func newZipCryptoKeys(password string) *zipCryptoKeys {
+	keys := &zipCryptoKeys{0x12345678, 0x23456789, 0x34567890}
+	for i := 0; i < len(password); i++ {
+		keys.update(password[i])
+	}
+	return keys
+}
+
+func (k *zipCryptoKeys) update(b byte) {
+	k[0] = crc32.IEEETable[byte(k[0])^b] ^ (k[0] >> 8)
+	k[1] = (k[1]+(k[0]&0xff))*134775813 + 1
+	k[2] = crc32.IEEETable[byte(k[2])^byte(k[1]>>24)] ^ (k[2] >> 8)
+}
+
+func (k *zipCryptoKeys) streamByte() byte {
+	temp := k[2] | 2
+	return byte((temp * (temp ^ 1)) >> 8)
+}
+
+func (k *zipCryptoKeys) encrypt(dst, src []byte) {
+	for i, b := range src {
+		dst[i] = b ^ k.streamByte()
+		k.update(b)
+	}
+}
+
+func (k *zipCryptoKeys) decrypt(dst, src []byte) {
+	for i, b := range src {
+		dst[i] = b ^ k.streamByte()
+		k.update(dst[i])
+	}
+}
+
+// zipCryptoEncrypter writes the encryption header, then the encrypted content.
+type zipCryptoEncrypter struct {
+	w    io.Writer
+	keys *zipCryptoKeys
+	buf  []byte
+}
+
+func newZipCryptoEncrypter(w io.Writer, password string, check byte) (*zipCryptoEncrypter, error) {
+	header := make([]byte, zipCryptoHeaderLength)
+	if _, err := rand.Read(header[:zipCryptoHeaderLength-1]); err != nil {
+		return nil, err
+	}
+	header[zipCryptoHeaderLength-1] = check
+
+	e := &zipCryptoEncrypter{w: w, keys: newZipCryptoKeys(password)}
+	if _, err := e.Write(header); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *zipCryptoEncrypter) Write(p []byte) (int, error) {
+	if cap(e.buf) < len(p) {
+		e.buf = make([]byte, len(p))
+	}
+	buf := e.buf[:len(p)]
+	e.keys.encrypt(buf, p)
+	return e.w.Write(buf)
+}
+
+func (e *zipCryptoEncrypter) Close() error {
+	return nil
+}
+
+// zipCryptoDecrypter decrypts the content following the encryption header.
+type zipCryptoDecrypter struct {
+	r    io.Reader
+	keys *zipCryptoKeys
+}
+
+func newZipCryptoDecrypter(raw io.Reader, password string, check byte) (*zipCryptoDecrypter, error) {
+	d := &zipCryptoDecrypter{r: raw, keys: newZipCryptoKeys(password)}
+	header := make([]byte, zipCryptoHeaderLength)
+	if _, err := io.ReadFull(d, header); err != nil {
+		return nil, err
+	}
+	if header[zipCryptoHeaderLength-1] != check {
+		return nil, errWrongPassword
+	}
+	return d, nil
+}
+
+func (d *zipCryptoDecrypter) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.keys.decrypt(p[:n], p[:n])
+	return n, err
+}
+
+// openZIPEntry returns the decompressed content of the entry, decrypting it if needed.
+// The content of an unencrypted or ZipCrypto encrypted entry is checked against its CRC-32 when it is fully read.
+func openZIPEntry(f *zip.File, password string) (io.ReadCloser, error) {
+	if f.Flags&flagEncrypted == 0 {
+		return f.Open()
+	}
+	if password == "" {
+		return nil, errors.New("the entry is encrypted, but no password is provided")
+	}
+
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	method := f.Method
+	var decrypted io.Reader
+	var verify func() error
+	if f.Method == aesMethod {
+		if method, err = parseAESExtra(f.Extra); err != nil {
+			return nil, err
+		}
+		aesReader, err := newAESDecrypter(raw, int64(f.CompressedSize64), password)
+		if err != nil {
+			return nil, err
+		}
+		decrypted, verify = aesReader, aesReader.verify
+	} else {
+		check := byte(f.CRC32 >> 24)
+		if f.Flags&flagDataDescriptor != 0 {
+			check = byte(f.ModifiedTime >> 8)
+		}
+		if decrypted, err = newZipCryptoDecrypter(raw, password, check); err != nil {
+			return nil, err
+		}
+	}
+
+	var content io.ReadCloser
+	switch method {
+	case zip.Store:
+		content = io.NopCloser(decrypted)
+	case zip.Deflate:
+		content = flate.NewReader(decrypted)
+	default:
+		return nil, fmt.Errorf("unsupported compression method (%d)", method)
+	}
+
+	return &decryptedEntryReader{
+		r:        content,
+		hash:     crc32.NewIEEE(),
+		checkCRC: f.Method != aesMethod || f.CRC32 != 0, // AE-2 entries store no CRC
+		expected: f.CRC32,
+		size:     f.UncompressedSize64,
+		verify:   verify,
+	}, nil
+}
+
+// decryptedEntryReader checks the size, the CRC-32 and the authentication code of the content when it is fully read.
+type decryptedEntryReader struct {
+	r        io.ReadCloser
+	hash     hash.Hash32
+	checkCRC bool
+	expected uint32
+	size     uint64
+	read     uint64
+	verify   func() error
+}
+
+func (d *decryptedEntryReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.read += uint64(n)
+	if err != io.EOF {
+		return n, err
+	}
+
+	if d.read != d.size {
+		return n, fmt.Errorf("size mismatch: expected %d bytes, read %d bytes", d.size, d.read)
+	}
+	if d.checkCRC && d.hash.Sum32() != d.expected {
+		return n, errors.New("checksum mismatch, the entry is corrupt")
+	}
+	if d.verify != nil {
+		if err := d.verify(); err != nil {
+			return n, err
+		}
+	}
+	return n, io.EOF
+}
+
+func (d *decryptedEntryReader) Close() error {
+	return d.r.Close()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
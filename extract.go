@@ -0,0 +1,511 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// detectArchiveFormat returns the format of the archive based on its extension,
+// falling back to the given format if the extension is not recognized.
+func detectArchiveFormat(pth string, fallback archiveFormat) archiveFormat {
+	name := strings.ToLower(pth)
+	for _, format := range []archiveFormat{formatTarGz, formatTarZst, formatTarXz, formatTar, formatZIP} {
+		if strings.HasSuffix(name, format.extension()) {
+			return format
+		}
+	}
+	if strings.HasSuffix(name, ".tgz") {
+		return formatTarGz
+	}
+	return fallback
+}
+
+// extract extracts the archive given as the source path into the destination directory and exports the outputs.
+func extract(cfg config) error {
+	sources := splitList(cfg.SourcePath)
+	if len(sources) != 1 {
+		return fmt.Errorf("exactly one archive has to be given as the source path in extract mode, got %d", len(sources))
+	}
+	archivePth := sources[0]
+	if err := checkArchiveIsFile(archivePth); err != nil {
+		return err
+	}
+	if cfg.Destination == "" {
+		return fmt.Errorf("the destination directory has to be set in extract mode")
+	}
+
+	fallback, err := parseArchiveFormat(cfg.ArchiveFormat)
+	if err != nil {
+		return err
+	}
+	format := detectArchiveFormat(archivePth, fallback)
+
+	log.Printf("")
+	log.Infof("Extracting %s (%s) to %s", archivePth, format, cfg.Destination)
+
+	entries, err := extractArchive(archivePth, cfg.Destination, format, string(cfg.EncryptionPassword))
+	if err != nil {
+		return err
+	}
+	log.Printf("%d entries extracted", entries)
+
+	pth, err := filepath.Abs(cfg.Destination)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("")
+	log.Infof("Exporting outputs")
+
+	for _, output := range []struct{ key, value string }{
+		{"BITRISE_ZIP_EXTRACTED_PATH", pth},
+		{"BITRISE_ZIP_ENTRY_COUNT", strconv.Itoa(entries)},
+	} {
+		if err := exportEnvironmentWithEnvman(output.key, output.value); err != nil {
+			return fmt.Errorf("failed to export %s: %s", output.key, err)
+		}
+		log.Donef("$%s = %s", output.key, output.value)
+	}
+	return nil
+}
+
+func checkArchiveIsFile(pth string) error {
+	info, err := os.Stat(pth)
+	if err != nil {
+		return fmt.Errorf("failed to check archive (%s): %s", pth, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("archive (%s) is not a file", pth)
+	}
+
+	// The volumes of a split ZIP archive are not read, the central directory would point into them.
+	volume := strings.TrimSuffix(pth, filepath.Ext(pth)) + ".z01"
+	if strings.EqualFold(filepath.Ext(pth), ".zip") {
+		if _, err := os.Stat(volume); err == nil {
+			return fmt.Errorf("archive (%s) is a split ZIP archive, join its volumes first with: zip -s 0 %s --out joined.zip", pth, pth)
+		}
+	}
+	return nil
+}
+
+// extractArchive extracts the entries of the archive into the destination directory,
+// restoring the symlinks, the permissions and the modification times. Existing files are overwritten.
+// The owners of the entries are restored only if the Step runs as root.
+// It returns the number of extracted entries.
+func extractArchive(pth, destination string, format archiveFormat, password string) (int, error) {
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return 0, err
+	}
+	root, err := filepath.Abs(destination)
+	if err != nil {
+		return 0, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return 0, err
+	}
+
+	x := &extractor{root: root, restoreOwner: os.Geteuid() == 0}
+	if format == formatZIP {
+		err = x.extractZIP(pth, password)
+	} else {
+		err = readTar(pth, format, x.extractTarEntry)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := x.checkSymlinks(); err != nil {
+		return 0, err
+	}
+
+	return x.entries, x.restoreDirs()
+}
+
+// extractor writes the entries of an archive below root. Every entry is checked not to escape root (zip-slip):
+// neither by its name, nor by being written through a symlink, nor by being a symlink pointing outside of root.
+type extractor struct {
+	root         string
+	dirs         []extractedDir
+	symlinks     []string
+	entries      int
+	restoreOwner bool
+}
+
+// extractedDir is a directory whose permissions and modification time are restored once its content is extracted,
+// so a read-only directory does not prevent extracting its content.
+type extractedDir struct {
+	pth     string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (x *extractor) extractZIP(pth, password string) error {
+	r, err := zip.OpenReader(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open archive (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	for _, f := range r.File {
+		if err := x.extractZIPEntry(f, password); err != nil {
+			return fmt.Errorf("archive (%s), entry (%s): %s", pth, f.Name, err)
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractZIPEntry(f *zip.File, password string) error {
+	mode := zipEntryMode(f)
+	owner := parseUnixOwnerExtra(f.Extra)
+	if strings.HasSuffix(f.Name, "/") || mode.IsDir() {
+		return x.dir(f.Name, mode, f.Modified, owner)
+	}
+
+	rc, err := openZIPEntry(f, password)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", f.Name, err)
+		}
+	}()
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(rc)
+		if err != nil {
+			return err
+		}
+		return x.symlink(f.Name, string(target), owner)
+	}
+	return x.file(f.Name, mode, f.Modified, owner, rc)
+}
+
+func (x *extractor) extractTarEntry(header *tar.Header, r io.Reader) error {
+	mode := header.FileInfo().Mode()
+	owner := &unixOwner{uid: header.Uid, gid: header.Gid}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		return x.dir(header.Name, mode, header.ModTime, owner)
+	case tar.TypeReg, tar.TypeRegA:
+		return x.file(header.Name, mode, header.ModTime, owner, r)
+	case tar.TypeSymlink:
+		return x.symlink(header.Name, header.Linkname, owner)
+	case tar.TypeLink:
+		return x.hardLink(header.Name, header.Linkname)
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		log.Warnf("Skipping %s: unsupported entry type (%c)", header.Name, header.Typeflag)
+		return nil
+	}
+}
+
+// target returns the path of the entry below root, refusing names which would escape it.
+// The parent directories of the entry are created, none of them can be a symlink.
+func (x *extractor) target(name string) (string, error) {
+	rel := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("refusing to extract entry outside of the destination (%s)", name)
+	}
+
+	pth := x.root
+	components := strings.Split(rel, string(filepath.Separator))
+	for _, component := range components[:len(components)-1] {
+		pth = filepath.Join(pth, component)
+		info, err := os.Lstat(pth)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(pth, 0755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract entry through a symlink (%s)", pth)
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("parent (%s) is not a directory", pth)
+		}
+	}
+	return filepath.Join(x.root, rel), nil
+}
+
+// removeExisting removes the file or symlink at pth, so it is replaced instead of being written through.
+func removeExisting(pth string) error {
+	info, err := os.Lstat(pth)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("a directory already exists at %s", pth)
+	}
+	return os.Remove(pth)
+}
+
+func (x *extractor) dir(name string, mode os.FileMode, modTime time.Time, owner *unixOwner) error {
+	if strings.TrimSuffix(name, "/") == "." {
+		return nil
+	}
+	pth, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(pth)
+	switch {
+	case os.IsNotExist(err):
+		if err := os.Mkdir(pth, 0755); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return fmt.Errorf("a file already exists at %s", pth)
+	}
+	if err := x.chown(pth, owner); err != nil {
+		return err
+	}
+
+	x.dirs = append(x.dirs, extractedDir{pth: pth, mode: mode.Perm(), modTime: modTime})
+	x.entries++
+	return nil
+}
+
+func (x *extractor) file(name string, mode os.FileMode, modTime time.Time, owner *unixOwner, r io.Reader) error {
+	pth, err := x.target(name)
+	if err != nil {
+		return err
+	}
+	if err := removeExisting(pth); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(pth, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		if cerr := f.Close(); cerr != nil {
+			log.Warnf("Failed to close %s: %s", pth, cerr)
+		}
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// The owner is set first, as changing it clears the setuid and setgid bits.
+	if err := x.chown(pth, owner); err != nil {
+		return err
+	}
+	// The permissions are set explicitly, so they are not affected by the umask.
+	if err := os.Chmod(pth, mode.Perm()); err != nil {
+		return err
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(pth, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	x.entries++
+	return nil
+}
+
+func (x *extractor) symlink(name, target string, owner *unixOwner) error {
+	pth, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	if !x.isLinkWithinRoot(pth, target) {
+		return fmt.Errorf("refusing to create symlink pointing outside of the destination (%s -> %s)", name, target)
+	}
+
+	if err := removeExisting(pth); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, pth); err != nil {
+		return err
+	}
+	if err := x.chown(pth, owner); err != nil {
+		return err
+	}
+	x.symlinks = append(x.symlinks, pth)
+	x.entries++
+	return nil
+}
+
+// isLinkWithinRoot reports whether the symlink at pth pointing to target resolves below root.
+func (x *extractor) isLinkWithinRoot(pth, target string) bool {
+	if filepath.IsAbs(target) {
+		return false
+	}
+	resolved, ok := resolveLinkTarget(filepath.Dir(pth), target)
+	return ok && x.isWithinRoot(resolved)
+}
+
+// checkSymlinks checks the extracted symlinks again once every entry is written, as a later entry can replace
+// a symlink which an earlier symlink's target goes through. The symlinks pointing outside of root are removed.
+func (x *extractor) checkSymlinks() error {
+	var escaping []string
+	for _, pth := range x.symlinks {
+		target, err := os.Readlink(pth)
+		if os.IsNotExist(err) {
+			// Replaced by a later entry, which is checked on its own.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		within := x.isLinkWithinRoot(pth, target)
+		if resolved, err := filepath.EvalSymlinks(pth); err == nil {
+			within = within && x.isWithinRoot(resolved)
+		}
+		if within {
+			continue
+		}
+
+		if err := os.Remove(pth); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(x.root, pth)
+		if err != nil {
+			return err
+		}
+		escaping = append(escaping, fmt.Sprintf("%s -> %s", filepath.ToSlash(rel), target))
+	}
+
+	if len(escaping) > 0 {
+		return fmt.Errorf("refusing to keep symlinks pointing outside of the destination, removed: %s", strings.Join(escaping, ", "))
+	}
+	return nil
+}
+
+func (x *extractor) hardLink(name, linkName string) error {
+	pth, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	rel := filepath.FromSlash(strings.TrimSuffix(linkName, "/"))
+	if !filepath.IsLocal(rel) {
+		return fmt.Errorf("refusing to create hard link to a file outside of the destination (%s -> %s)", name, linkName)
+	}
+	target, err := x.target(linkName)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("refusing to create hard link to a non-regular file (%s -> %s)", name, linkName)
+	}
+
+	if err := removeExisting(pth); err != nil {
+		return err
+	}
+	if err := os.Link(target, pth); err != nil {
+		return err
+	}
+	x.entries++
+	return nil
+}
+
+// chown sets the owner of the extracted file, symlinks are not followed.
+// Nothing is changed if the owner is not stored in the archive or the Step does not run as root.
+func (x *extractor) chown(pth string, owner *unixOwner) error {
+	if owner == nil || !x.restoreOwner {
+		return nil
+	}
+	return os.Lchown(pth, owner.uid, owner.gid)
+}
+
+func (x *extractor) isWithinRoot(pth string) bool {
+	rel, err := filepath.Rel(x.root, pth)
+	if err != nil {
+		return false
+	}
+	return rel == "." || filepath.IsLocal(rel)
+}
+
+// resolveLinkTarget returns the path which a symlink in dir pointing to target resolves to.
+// The already existing symlinks are followed component by component, so a target like link/.. is resolved
+// the way the operating system does, not lexically.
+// A component which does not exist yet, or is a dangling symlink, may be created as a symlink later,
+// so a .. following it can not be resolved: ok is false in this case.
+func resolveLinkTarget(dir, target string) (pth string, ok bool) {
+	pth = dir
+	unresolved := false
+	for _, component := range strings.Split(filepath.FromSlash(target), string(filepath.Separator)) {
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if unresolved {
+				return "", false
+			}
+			pth = filepath.Dir(pth)
+			continue
+		}
+
+		pth = filepath.Join(pth, component)
+		if unresolved {
+			continue
+		}
+		info, err := os.Lstat(pth)
+		if err != nil {
+			unresolved = true
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(pth)
+			if err != nil {
+				unresolved = true
+				continue
+			}
+			pth = resolved
+		}
+	}
+	return pth, true
+}
+
+// restoreDirs restores the permissions and the modification times of the extracted directories,
+// the deepest first, as the modification time of a directory changes when its content is written.
+func (x *extractor) restoreDirs() error {
+	sort.SliceStable(x.dirs, func(i, j int) bool {
+		return strings.Count(x.dirs[i].pth, string(filepath.Separator)) > strings.Count(x.dirs[j].pth, string(filepath.Separator))
+	})
+	for _, dir := range x.dirs {
+		if err := os.Chmod(dir.pth, dir.mode); err != nil {
+			return err
+		}
+		if !dir.modTime.IsZero() {
+			if err := os.Chtimes(dir.pth, dir.modTime, dir.modTime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// filterRule is a single gitignore-style pattern.
+type filterRule struct {
+	pattern string
+	glob    string
+	negate  bool
+	dirOnly bool
+	// skipped and kept count the entries the rule decided on, as the last matching rule.
+	skipped int
+	kept    int
+}
+
+// entryFilter decides which entries of the walked sources are archived.
+// Paths are matched relative to the source they belong to.
+type entryFilter struct {
+	includes    []*filterRule
+	excludes    []*filterRule
+	notIncluded int
+}
+
+func newEntryFilter(includePatterns, excludePatterns []string) (*entryFilter, error) {
+	includes, err := parseFilterRules(includePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern: %s", err)
+	}
+
+	excludes, err := parseFilterRules(excludePatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %s", err)
+	}
+
+	return &entryFilter{includes: includes, excludes: excludes}, nil
+}
+
+// parseFilterRules converts gitignore-style patterns to rules:
+// a leading `!` negates the pattern, a trailing `/` matches only directories,
+// a pattern containing a `/` is matched from the root of the source, otherwise it matches at any depth.
+func parseFilterRules(patterns []string) ([]*filterRule, error) {
+	var rules []*filterRule
+	for _, pattern := range patterns {
+		rule := &filterRule{pattern: pattern}
+
+		glob := pattern
+		if strings.HasPrefix(glob, "!") {
+			rule.negate = true
+			glob = glob[1:]
+		}
+		if strings.HasSuffix(glob, "/") {
+			rule.dirOnly = true
+			glob = strings.TrimRight(glob, "/")
+		}
+		if strings.Contains(glob, "/") {
+			glob = strings.TrimPrefix(glob, "/")
+		} else {
+			glob = "**/" + glob
+		}
+		if glob == "" || glob == "**/" {
+			return nil, fmt.Errorf("empty pattern (%s)", pattern)
+		}
+		if _, err := path.Match(strings.Replace(glob, "**", "*", -1), ""); err != nil {
+			return nil, fmt.Errorf("%s: %s", pattern, err)
+		}
+
+		rule.glob = glob
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// lastMatch returns the last rule matching the slash separated path, as in gitignore the last match wins.
+func lastMatch(rules []*filterRule, rel string, isDir bool) *filterRule {
+	var match *filterRule
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchGlob(rule.glob, rel) {
+			match = rule
+		}
+	}
+	return match
+}
+
+// excludedBy returns the exclude rule which skips the given path or nil if the path is not excluded.
+// The contents of an excluded directory are not visited at all.
+func (f *entryFilter) excludedBy(rel string, isDir bool) *filterRule {
+	rule := lastMatch(f.excludes, rel, isDir)
+	if rule == nil {
+		return nil
+	}
+	if rule.negate {
+		rule.kept++
+		return nil
+	}
+	return rule
+}
+
+// includedBy returns the last include rule matching the path or one of its parent directories,
+// the path is included if the rule is not negated. It returns nil if no rule matches.
+func (f *entryFilter) includedBy(rel string, isDir bool) *filterRule {
+	for pth := rel; pth != "."; pth, isDir = path.Dir(pth), true {
+		if rule := lastMatch(f.includes, pth, isDir); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// filter applies the rules to the entries of a source.
+// Excluded directories are expected to be skipped by the caller together with their contents.
+// If include rules are given, directories are kept only if they are included or contain an included entry.
+func (f *entryFilter) filter(entries []archiveEntry, rels []string) []archiveEntry {
+	if len(f.includes) == 0 {
+		return entries
+	}
+
+	rules := make([]*filterRule, len(entries))
+	keptDirs := map[string]bool{}
+	for i, entry := range entries {
+		rules[i] = f.includedBy(rels[i], entry.info.IsDir())
+		if rules[i] != nil && !rules[i].negate {
+			for dir := rels[i]; dir != "."; {
+				dir = path.Dir(dir)
+				keptDirs[dir] = true
+			}
+		}
+	}
+
+	var filtered []archiveEntry
+	for i, entry := range entries {
+		rule := rules[i]
+		switch {
+		case rule != nil && !rule.negate:
+			rule.kept++
+			filtered = append(filtered, entry)
+		case keptDirs[rels[i]]:
+			filtered = append(filtered, entry)
+		case rule != nil:
+			rule.skipped++
+		default:
+			f.notIncluded++
+		}
+	}
+	return filtered
+}
+
+func (f *entryFilter) printSummary() {
+	if len(f.includes) == 0 && len(f.excludes) == 0 {
+		return
+	}
+
+	log.Printf("")
+	log.Infof("Filter summary")
+	for _, rule := range f.includes {
+		if rule.negate {
+			log.Printf("- include %s: %d skipped", rule.pattern, rule.skipped)
+		} else {
+			log.Printf("- include %s: %d kept", rule.pattern, rule.kept)
+		}
+	}
+	if len(f.includes) > 0 {
+		log.Printf("- not matching the include patterns: %d skipped", f.notIncluded)
+	}
+	for _, rule := range f.excludes {
+		if rule.negate {
+			log.Printf("- exclude %s: %d kept", rule.pattern, rule.kept)
+		} else {
+			log.Printf("- exclude %s: %d skipped", rule.pattern, rule.skipped)
+		}
+	}
+	log.Printf("Excluded directories are counted as a single entry.")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// maxUploadResponseLen is the length of the response body exported as the upload response.
+	maxUploadResponseLen = 10 * 1024
+	// maxUploadErrorBodyLen is the length of the response body included in the error of an unexpected response.
+	maxUploadErrorBodyLen = 1024
+)
+
+// httpUpload uploads the archive to an HTTP endpoint, either as the body of a PUT request
+// or as a file field of a multipart/form-data POST request.
+type httpUpload struct {
+	url         string
+	method      string
+	formField   string
+	headers     http.Header
+	statusCodes []string
+	maxRetries  int
+	backoff     time.Duration
+	client      *http.Client
+}
+
+// parseHTTPUpload validates the HTTP upload inputs, it returns nil if no upload URL is set.
+func parseHTTPUpload(cfg config) (*httpUpload, error) {
+	if cfg.UploadURL == "" {
+		return nil, nil
+	}
+
+	target, err := url.Parse(cfg.UploadURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid upload URL, it has to be an http or https URL")
+	}
+
+	u := &httpUpload{
+		url:        cfg.UploadURL,
+		method:     cfg.UploadMethod,
+		formField:  cfg.UploadFormField,
+		headers:    http.Header{},
+		maxRetries: cfg.UploadMaxRetries,
+		backoff:    time.Duration(cfg.UploadRetryBackoff) * time.Second,
+		client:     &http.Client{},
+	}
+	if u.method == "" {
+		u.method = http.MethodPut
+	}
+	if u.formField == "" {
+		u.formField = "file"
+	}
+	if u.maxRetries < 0 {
+		return nil, fmt.Errorf("invalid upload max retries (%d), it has to be a positive number or 0", u.maxRetries)
+	}
+	if cfg.UploadRetryBackoff < 0 {
+		return nil, fmt.Errorf("invalid upload retry backoff (%d), it has to be a positive number or 0", cfg.UploadRetryBackoff)
+	}
+
+	// The headers are newline separated only, as a value can contain a `|`.
+	// The values are not included in the errors, the headers usually hold credentials.
+	for _, line := range strings.Split(string(cfg.UploadHeaders), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid upload header, it has to be in the Name: Value format")
+		}
+		u.headers.Add(name, strings.TrimSpace(value))
+	}
+
+	for _, code := range splitList(strings.ReplaceAll(cfg.UploadStatusCodes, ",", "\n")) {
+		code = strings.ToLower(code)
+		if !isStatusCodePattern(code) {
+			return nil, fmt.Errorf("invalid expected status code (%s), it has to be a status code like 201 or a class like 2xx", code)
+		}
+		u.statusCodes = append(u.statusCodes, code)
+	}
+	if len(u.statusCodes) == 0 {
+		u.statusCodes = []string{"2xx"}
+	}
+
+	return u, nil
+}
+
+// isStatusCodePattern reports whether the code is a three digit status code, or a class of them like 2xx.
+func isStatusCodePattern(code string) bool {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return false
+	}
+	if code[1:] == "xx" {
+		return true
+	}
+	for _, c := range code[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// expects reports whether the status code is one of the expected ones.
+func (u *httpUpload) expects(statusCode int) bool {
+	code := strconv.Itoa(statusCode)
+	for _, expected := range u.statusCodes {
+		if expected == code || (strings.HasSuffix(expected, "xx") && expected[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadArchive uploads the archive and returns the body of the response.
+func (u *httpUpload) uploadArchive(destination string, result archiveResult) (string, error) {
+	if len(result.parts) > 0 {
+		return "", fmt.Errorf("a split archive can not be uploaded to an HTTP endpoint")
+	}
+
+	log.Printf("")
+	log.Infof("Uploading to %s", u.url)
+
+	f, err := os.Open(destination)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", destination, err)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	started := time.Now()
+	var body []byte
+	err = retry(u.maxRetries, u.backoff, func() (bool, error) {
+		req, err := u.request(f, info.Size())
+		if err != nil {
+			return false, err
+		}
+
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+		// Error pages can be large, only the part which is logged or exported is read.
+		respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxUploadResponseLen+1))
+		if err != nil {
+			return true, err
+		}
+
+		if !u.expects(resp.StatusCode) {
+			retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+			return retryable, fmt.Errorf("unexpected response status: %s, body: %s", resp.Status, truncateResponse(respBody, maxUploadErrorBodyLen))
+		}
+		body = respBody
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %s", destination, err)
+	}
+
+	log.Donef("Uploaded %s (%s) in %s", filepath.Base(destination), formatBytes(info.Size()), time.Since(started).Round(time.Millisecond))
+	return truncateResponse(body, maxUploadResponseLen), nil
+}
+
+// truncateResponse returns the response body cut to at most limit bytes on a character boundary,
+// marking the cut.
+func truncateResponse(body []byte, limit int) string {
+	if len(body) <= limit {
+		return string(body)
+	}
+	n := limit
+	for n > 0 && !utf8.RuneStart(body[n]) {
+		n--
+	}
+	return string(body[:n]) + "... (truncated)"
+}
+
+// request returns a new request streaming the file, the body is recreated for every attempt.
+func (u *httpUpload) request(f *os.File, size int64) (*http.Request, error) {
+	var body io.Reader = io.NewSectionReader(f, 0, size)
+	contentType := "application/octet-stream"
+	contentLength := size
+
+	if u.method == http.MethodPost {
+		// The multipart envelope is written ahead, so the file can be streamed with a known content length.
+		var head bytes.Buffer
+		mw := multipart.NewWriter(&head)
+		if _, err := mw.CreateFormFile(u.formField, filepath.Base(f.Name())); err != nil {
+			return nil, err
+		}
+		prefix := bytes.Clone(head.Bytes())
+		head.Reset()
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+
+		body = io.MultiReader(bytes.NewReader(prefix), body, bytes.NewReader(head.Bytes()))
+		contentType = mw.FormDataContentType()
+		contentLength += int64(len(prefix) + head.Len())
+	}
+
+	req, err := http.NewRequest(u.method, u.url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = contentLength
+	req.Header.Set("Content-Type", contentType)
+	for name, values := range u.headers {
+		req.Header[name] = values
+	}
+	return req, nil
+}
@@ -4,16 +4,65 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/log"
 	"github.com/bitrise-io/go-utils/pathutil"
-	"github.com/bitrise-io/go-utils/ziputil"
 	"github.com/bitrise-tools/go-steputils/stepconf"
 )
 
 type config struct {
-	SourcePath  string `env:"source_path,file"`
-	Destination string `env:"destination"`
+	Mode            string `env:"mode,opt[create,extract,verify]"`
+	Archives        string `env:"archives"`
+	SourcePath      string `env:"source_path"`
+	Destination     string `env:"destination"`
+	IncludePatterns string `env:"include_patterns"`
+	ExcludePatterns string `env:"exclude_patterns"`
+	ContentOnly     bool   `env:"content_only,opt[yes,no]"`
+	ArchiveRoot     string `env:"archive_root"`
+	IfExists        string `env:"if_exists,opt[fail,overwrite,append,rename]"`
+	DryRun          bool   `env:"dry_run,opt[yes,no]"`
+	SymlinkMode     string `env:"symlink_mode,opt[preserve,follow,skip,follow-within-source]"`
+	UnixMetadata    string `env:"unix_metadata,opt[preserve,normalize,strip]"`
+	RequiredPaths   string `env:"required_paths"`
+
+	ArchiveFormat             string `env:"archive_format,opt[zip,tar,tar.gz,tar.zst,tar.xz]"`
+	CompressionLevel          int    `env:"compression_level,opt[0,1,2,3,4,5,6,7,8,9]"`
+	CompressionLevelOverrides string `env:"compression_level_overrides"`
+	ChecksumAlgorithms        string `env:"checksum_algorithms"`
+	ManifestFormat            string `env:"manifest_format,opt[none,json,csv]"`
+	Reproducible              bool   `env:"reproducible,opt[yes,no]"`
+	SplitSize                 string `env:"split_size"`
+	SplitMode                 string `env:"split_mode,opt[zip,chunks]"`
+	Parallelism               int    `env:"parallelism"`
+	ProgressInterval          int    `env:"progress_interval"`
+
+	ForceZIP64   bool `env:"force_zip64,opt[yes,no]"`
+	DisableZIP64 bool `env:"disable_zip64,opt[yes,no]"`
+
+	EncryptionPassword stepconf.Secret `env:"encryption_password"`
+	EncryptionMethod   string          `env:"encryption_method,opt[aes256,zipcrypto]"`
+
+	S3Bucket          string          `env:"s3_bucket"`
+	S3Endpoint        string          `env:"s3_endpoint"`
+	S3Region          string          `env:"s3_region"`
+	S3Key             string          `env:"s3_key"`
+	S3AccessKeyID     stepconf.Secret `env:"s3_access_key_id"`
+	S3SecretAccessKey stepconf.Secret `env:"s3_secret_access_key"`
+	S3SessionToken    stepconf.Secret `env:"s3_session_token"`
+	S3PartSize        string          `env:"s3_part_size"`
+	S3MaxRetries      int             `env:"s3_max_retries"`
+
+	UploadURL          string          `env:"upload_url"`
+	UploadMethod       string          `env:"upload_method,opt[PUT,POST]"`
+	UploadFormField    string          `env:"upload_form_field"`
+	UploadHeaders      stepconf.Secret `env:"upload_headers"`
+	UploadStatusCodes  string          `env:"upload_expected_status_codes"`
+	UploadMaxRetries   int             `env:"upload_max_retries"`
+	UploadRetryBackoff int             `env:"upload_retry_backoff"`
 }
 
 func main() {
@@ -25,37 +74,416 @@ func main() {
 
 	stepconf.Print(cfg)
 
-	destination := cfg.Destination
-	destination, err := fixDestination(destination, cfg.SourcePath)
+	if cfg.Archives != "" {
+		if cfg.Mode != "create" {
+			failf("Issue with batch: only the create mode is supported in batch mode, got %s", cfg.Mode)
+		}
+		if err := runBatch(cfg.Archives); err != nil {
+			failf("Issue with batch: %s", err)
+		}
+		return
+	}
+
+	switch cfg.Mode {
+	case "extract":
+		if err := extract(cfg); err != nil {
+			failf("Issue with extract: %s", err)
+		}
+		return
+	case "verify":
+		if err := verify(cfg); err != nil {
+			failf("Issue with verify: %s", err)
+		}
+		return
+	}
+
+	destination, result, err := create(cfg)
 	if err != nil {
 		failf("Issue with compress: %s", err)
 	}
+	if cfg.DryRun {
+		return
+	}
 
-	if err := checkAlreadyExist(destination); err != nil {
-		failf("Issue with compress: %s", err)
+	if err := exportOutputs(destination, result); err != nil {
+		failf("Failed to export outputs: %s", err)
 	}
+}
 
-	if err := ensureZIP(cfg.SourcePath, destination); err != nil {
-		failf("Issue with compress: %s", err)
+// create archives the sources according to the config and returns the destination and the result.
+// In dry run mode, only the entries are listed and the result is empty.
+func create(cfg config) (string, archiveResult, error) {
+	sources, err := resolveSources(splitList(cfg.SourcePath))
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	filter, err := newEntryFilter(splitList(cfg.IncludePatterns), splitList(cfg.ExcludePatterns))
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	root, err := parseArchiveRoot(cfg.ArchiveRoot)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	links, err := parseSymlinkMode(cfg.SymlinkMode)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+	layout := archiveLayout{contentOnly: cfg.ContentOnly, root: root}
+
+	opts, err := parseArchiveOptions(cfg, layout)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	s3, err := parseS3Upload(cfg)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	upload, err := parseHTTPUpload(cfg)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	destination := cfg.Destination
+	destination, err = fixDestination(destination, archiveBaseName(sources), opts.format)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	destination, opts.appendTo, err = applyExistsPolicy(destination, cfg.IfExists, opts)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+	if opts.appendTo && opts.splitSize > 0 {
+		return "", archiveResult{}, fmt.Errorf("entries can not be appended to a split archive, use a different if_exists policy")
+	}
+
+	entries, err := collectArchiveEntries(sources, filter, layout, links, opts)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	if cfg.DryRun {
+		printDryRun(destination, entries, opts)
+		return destination, archiveResult{}, nil
+	}
+
+	if err := ensureDestinationPath(destination); err != nil {
+		return "", archiveResult{}, err
+	}
+
+	result, err := writeArchive(entries, destination, opts)
+	if err != nil {
+		return "", archiveResult{}, err
+	}
+
+	if s3 != nil {
+		if result.s3URLs, err = s3.uploadArchive(destination, result); err != nil {
+			return "", archiveResult{}, err
+		}
+	}
+	if upload != nil {
+		response, err := upload.uploadArchive(destination, result)
+		if err != nil {
+			return "", archiveResult{}, err
+		}
+		result.uploadResponse = &response
+	}
+	return destination, result, nil
+}
+
+// parseArchiveOptions validates the inputs configuring how the archive is written.
+func parseArchiveOptions(cfg config, layout archiveLayout) (archiveOptions, error) {
+	format, err := parseArchiveFormat(cfg.ArchiveFormat)
+	if err != nil {
+		return archiveOptions{}, err
+	}
+
+	levels, err := parseCompressionLevels(cfg.CompressionLevel, splitList(cfg.CompressionLevelOverrides))
+	if err != nil {
+		return archiveOptions{}, err
+	}
+	if format != formatZIP && len(levels.extensionLevels) > 0 {
+		log.Warnf("Compression level overrides are ignored for the %s format, the whole archive is compressed with level %d", format, levels.level)
+	}
+
+	checksums, err := parseChecksumAlgorithms(splitList(cfg.ChecksumAlgorithms))
+	if err != nil {
+		return archiveOptions{}, err
+	}
+
+	opts := archiveOptions{format: format, levels: levels, checksums: checksums}
+
+	if opts.manifestFormat, err = parseManifestFormat(cfg.ManifestFormat); err != nil {
+		return archiveOptions{}, err
+	}
+	if opts.manifestFormat != "" {
+		opts.manifestName = manifestName(opts.manifestFormat, layout)
+	}
+
+	if cfg.Reproducible {
+		opts.reproducible = true
+		if opts.modTime, err = reproducibleModTime(); err != nil {
+			return archiveOptions{}, err
+		}
+	}
+
+	if opts.splitSize, err = parseSplitSize(cfg.SplitSize); err != nil {
+		return archiveOptions{}, err
+	}
+	if opts.splitSize > 0 {
+		if opts.splitMode, err = parseSplitMode(cfg.SplitMode, format); err != nil {
+			return archiveOptions{}, err
+		}
+	}
+
+	if opts.parallelism, err = parseParallelism(cfg.Parallelism); err != nil {
+		return archiveOptions{}, err
 	}
 
+	if opts.zip64, err = parseZIP64Mode(cfg.ForceZIP64, cfg.DisableZIP64); err != nil {
+		return archiveOptions{}, err
+	}
+	if format != formatZIP && opts.zip64 != zip64Auto {
+		log.Warnf("The ZIP64 options are ignored for the %s format", format)
+	}
+
+	if opts.unixMetadata, err = parseUnixMetadata(cfg.UnixMetadata, format); err != nil {
+		return archiveOptions{}, err
+	}
+
+	if cfg.ProgressInterval < 0 {
+		return archiveOptions{}, fmt.Errorf("invalid progress interval (%d), it has to be a positive number of seconds or 0 to disable the progress lines", cfg.ProgressInterval)
+	}
+	opts.progressInterval = time.Duration(cfg.ProgressInterval) * time.Second
+
+	opts.password = string(cfg.EncryptionPassword)
+	if opts.encryption, err = parseZIPEncryption(opts.password, cfg.EncryptionMethod); err != nil {
+		return archiveOptions{}, err
+	}
+	if opts.encryption != encryptionNone {
+		if format != formatZIP {
+			return archiveOptions{}, fmt.Errorf("encryption is supported only for the zip format, not for %s", format)
+		}
+		if opts.encryption == encryptionZipCrypto {
+			log.Warnf("ZipCrypto encryption is weak and can be broken, use it only if the archive has to be opened by tools without AES support")
+		}
+		if opts.reproducible {
+			log.Warnf("Encrypted entries use a random salt, the archive is not byte-identical between runs")
+		}
+	}
+
+	return opts, nil
 }
 
-func ensureZIP(sourcePath string, destination string) error {
-	info, err := os.Lstat(sourcePath)
+// collectArchiveEntries walks the sources and returns the entries of the archive, in the order they are written.
+func collectArchiveEntries(sources []string, filter *entryFilter, layout archiveLayout, links symlinkMode, opts archiveOptions) ([]archiveEntry, error) {
+	entries, err := collectEntries(sources, filter, layout, links)
+	if err != nil {
+		return nil, err
+	}
+	if opts.unixMetadata == unixNormalize {
+		entries = normalizeUnixMetadata(entries)
+	}
+	if opts.reproducible {
+		entries = normalizeEntries(entries, opts.modTime)
+	}
+	for _, entry := range entries {
+		if entry.name == opts.manifestName {
+			return nil, fmt.Errorf("%s would be overwritten by the manifest in the archive", entry.pth)
+		}
+	}
+	filter.printSummary()
+
+	return entries, nil
+}
+
+// printDryRun prints the destination and the entries which would be archived, without writing anything.
+func printDryRun(destination string, entries []archiveEntry, opts archiveOptions) {
+	log.Printf("")
+	log.Infof("Dry run, the archive would be created at %s", destination)
+	if opts.appendTo {
+		log.Printf("The entries would be added to the existing archive")
+	}
+
+	var total int64
+	for _, entry := range entries {
+		var size int64
+		if entry.info.Mode().IsRegular() {
+			size = entry.info.Size()
+		}
+		total += size
+		log.Printf("%s %10d %s", entry.info.Mode(), size, entry.name)
+	}
+	if opts.manifestName != "" {
+		log.Printf("The %s manifest would be added as %s", opts.manifestFormat, opts.manifestName)
+	}
+
+	log.Printf("%d entries, %s in total before compression", len(entries), formatBytes(total))
+	if opts.splitSize > 0 && total > opts.splitSize {
+		log.Printf("The archive may be split into parts of at most %s", formatBytes(opts.splitSize))
+	}
+	log.Donef("Nothing was written")
+}
+
+// exportOutputs exports the path, the size, the number of entries, the checksums, the manifest path and the upload results of the created archive.
+func exportOutputs(destination string, result archiveResult) error {
+	pth, err := filepath.Abs(destination)
 	if err != nil {
 		return err
 	}
 
-	if info.IsDir() {
-		return ziputil.ZipDir(sourcePath, destination, false)
+	size, err := archiveSize(pth, result)
+	if err != nil {
+		return err
+	}
+	var partPths []string
+	for _, part := range result.parts {
+		partPth, err := filepath.Abs(part.pth)
+		if err != nil {
+			return err
+		}
+		partPths = append(partPths, partPth)
+	}
+
+	log.Printf("")
+	log.Infof("Exporting outputs")
+
+	type output struct {
+		key   string
+		value string
+	}
+	outputs := []output{
+		{"BITRISE_ZIP_PATH", pth},
+		{"BITRISE_ZIP_SIZE", strconv.FormatInt(size, 10)},
+		{"BITRISE_ZIP_ENTRY_COUNT", strconv.Itoa(result.entries)},
+	}
+	for _, c := range result.checksums {
+		outputs = append(outputs, output{c.outputKey(), c.digest()})
+	}
+	if result.manifestPath != "" {
+		manifestPth, err := filepath.Abs(result.manifestPath)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, output{"BITRISE_ZIP_MANIFEST_PATH", manifestPth})
+	}
+	if len(partPths) > 0 {
+		outputs = append(outputs, output{"BITRISE_ZIP_PART_PATHS", strings.Join(partPths, "|")})
+	}
+	if len(result.s3URLs) > 0 {
+		outputs = append(outputs, output{"BITRISE_ZIP_S3_URL", strings.Join(result.s3URLs, "|")})
+	}
+	if result.uploadResponse != nil {
+		outputs = append(outputs, output{"BITRISE_ZIP_UPLOAD_RESPONSE", *result.uploadResponse})
+	}
+	for _, output := range outputs {
+		if err := exportEnvironmentWithEnvman(output.key, output.value); err != nil {
+			return fmt.Errorf("failed to export %s: %s", output.key, err)
+		}
+		log.Donef("$%s = %s", output.key, output.value)
 	}
 
-	return ziputil.ZipFile(sourcePath, destination)
+	return nil
+}
+
+// archiveSize returns the size of the archive, or the total size of its parts if it is split.
+func archiveSize(pth string, result archiveResult) (int64, error) {
+	if len(result.parts) == 0 {
+		info, err := os.Stat(pth)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	var size int64
+	for _, part := range result.parts {
+		size += part.size
+	}
+	return size, nil
+}
+
+func exportEnvironmentWithEnvman(key, value string) error {
+	cmd := command.New("envman", "add", "--key", key)
+	cmd.SetStdin(strings.NewReader(value))
+	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+		return fmt.Errorf("command: (%s) failed, output: %s, error: %s", cmd.PrintableCommandArgs(), out, err)
+	}
+	return nil
+}
+
+// applyExistsPolicy decides what happens if an archive already exists at the destination:
+// fail, overwrite it, append the new entries to it or write the archive with the next free name (name-1.zip, name-2.zip, ...).
+// If the archive may be split, the existing parts of a split archive at the destination count as an existing archive too.
+// It returns the destination to write and whether the existing archive has to be appended.
+func applyExistsPolicy(destination, policy string, opts archiveOptions) (string, bool, error) {
+	if policy == "fail" || policy == "" {
+		return destination, false, checkAlreadyExist(destination, opts.splitMode)
+	}
+
+	exist, err := isArchiveExists(destination, opts.splitMode)
+	if err != nil {
+		return "", false, err
+	}
+	if !exist {
+		return destination, false, nil
+	}
+
+	switch policy {
+	case "overwrite":
+		log.Warnf("The archive already exists at %s, it will be overwritten", destination)
+		return destination, false, nil
+	case "append":
+		log.Warnf("The archive already exists at %s, the entries will be added to it", destination)
+		return destination, true, nil
+	case "rename":
+		renamed, err := nextAvailableDestination(destination, opts)
+		if err != nil {
+			return "", false, err
+		}
+		log.Warnf("The archive already exists at %s, the new archive will be created at %s", destination, renamed)
+		return renamed, false, nil
+	default:
+		return "", false, fmt.Errorf("invalid if exists policy (%s)", policy)
+	}
+}
+
+// isArchiveExists reports whether the archive or, if the split mode is set, any part of a split archive exists at the destination.
+func isArchiveExists(destination string, split splitMode) (bool, error) {
+	exist, err := pathutil.IsPathExists(destination)
+	if err != nil || exist || split == "" {
+		return exist, err
+	}
+
+	parts, err := existingParts(destination, split)
+	return len(parts) > 0, err
+}
+
+// nextAvailableDestination returns the first name-N.ext path which does not exist yet.
+func nextAvailableDestination(destination string, opts archiveOptions) (string, error) {
+	ext := opts.format.extension()
+	base := destination[:len(destination)-len(ext)]
+	for i := 1; ; i++ {
+		pth := fmt.Sprintf("%s-%d%s", base, i, destination[len(base):])
+		exist, err := isArchiveExists(pth, opts.splitMode)
+		if err != nil {
+			return "", err
+		}
+		if !exist {
+			return pth, nil
+		}
+	}
 }
 
 // checkAlreadyExist will return an error if the zip has already exist at the destination.
-func checkAlreadyExist(destination string) error {
+// If the split mode is set, the parts of a split archive are checked too.
+func checkAlreadyExist(destination string, split splitMode) error {
 	targetName := filepath.Base(destination)
 
 	exist, err := pathutil.IsPathExists(destination)
@@ -67,25 +495,32 @@ func checkAlreadyExist(destination string) error {
 		return fmt.Errorf("The - %s - already exists at location: %s", targetName, destination)
 	}
 
+	if split == "" {
+		return nil
+	}
+	parts, err := existingParts(destination, split)
+	if err != nil {
+		return err
+	}
+	if len(parts) > 0 {
+		return fmt.Errorf("A part of the split - %s - already exists at location: %s", targetName, parts[0])
+	}
+
 	return nil
 }
 
-func fixDestination(destination string, sourcePath string) (string, error) {
+func fixDestination(destination string, baseName string, format archiveFormat) (string, error) {
 	destination = cleanDestination(destination)
 
-	if err := ensureDestinationPath(destination); err != nil {
-		return "", err
-	}
-
 	isDir, err := checkDestinationIsDir(destination)
 	if err != nil {
 		return "", err
 	}
 
 	if isDir {
-		destination = filepath.Join(destination, filepath.Base(sourcePath))
+		destination = filepath.Join(destination, baseName)
 	}
-	destination = fixDestinationExt(destination)
+	destination = fixDestinationExt(destination, format)
 
 	return destination, nil
 }
@@ -94,9 +529,9 @@ func cleanDestination(destination string) string {
 	return filepath.Clean(destination)
 }
 
-func fixDestinationExt(destination string) string {
-	if filepath.Ext(destination) != "zip" {
-		destination += ".zip"
+func fixDestinationExt(destination string, format archiveFormat) string {
+	if !strings.HasSuffix(strings.ToLower(destination), format.extension()) {
+		destination += format.extension()
 	}
 	return destination
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// manifestRecord describes a single entry of the archive.
+type manifestRecord struct {
+	Path          string    `json:"path"`
+	Size          int64     `json:"size"`
+	Mode          string    `json:"mode"`
+	ModTime       time.Time `json:"mtime"`
+	SymlinkTarget string    `json:"symlink_target,omitempty"`
+	SHA256        string    `json:"sha256,omitempty"`
+}
+
+func newManifestRecord(name string, mode os.FileMode, size int64, modTime time.Time) *manifestRecord {
+	return &manifestRecord{
+		Path:    name,
+		Size:    size,
+		Mode:    mode.String(),
+		ModTime: modTime.UTC().Truncate(time.Second),
+	}
+}
+
+func parseManifestFormat(format string) (string, error) {
+	switch format {
+	case "", "none":
+		return "", nil
+	case "json", "csv":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported manifest format (%s)", format)
+	}
+}
+
+// manifestName returns the name of the manifest in the archive.
+func manifestName(format string, layout archiveLayout) string {
+	return path.Join(layout.root, "manifest."+format)
+}
+
+// encodeManifest encodes the records as a JSON array or as a CSV table with a header row.
+func encodeManifest(records []manifestRecord, format string) ([]byte, error) {
+	if records == nil {
+		records = []manifestRecord{}
+	}
+
+	if format == "json" {
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write([]string{"path", "size", "mode", "mtime", "symlink_target", "sha256"}); err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := w.Write([]string{
+			record.Path,
+			strconv.FormatInt(record.Size, 10),
+			record.Mode,
+			record.ModTime.Format(time.RFC3339),
+			record.SymlinkTarget,
+			record.SHA256,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// writeManifestFile writes the manifest next to the archive and returns its path.
+func writeManifestFile(archivePth string, data []byte, format string) (string, error) {
+	pth := archivePth + ".manifest." + format
+	if err := os.WriteFile(pth, data, 0644); err != nil {
+		return "", err
+	}
+	return pth, nil
+}
+
+// contentHasher computes the SHA-256 of the entry contents written through it, if enabled.
+type contentHasher struct {
+	hash hash.Hash
+}
+
+func newContentHasher(enabled bool) *contentHasher {
+	if !enabled {
+		return &contentHasher{}
+	}
+	return &contentHasher{hash: sha256.New()}
+}
+
+// writer returns a writer which writes to w and hashes the written data.
+func (h *contentHasher) writer(w io.Writer) io.Writer {
+	if h.hash == nil {
+		return w
+	}
+	return io.MultiWriter(w, h.hash)
+}
+
+func (h *contentHasher) sum() string {
+	if h.hash == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
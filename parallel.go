@@ -0,0 +1,212 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// spoolMemoryLimit is the size up to which a compressed entry is kept in memory,
+// larger entries are spooled to a temporary file until they are written to the archive.
+const spoolMemoryLimit = 4 * 1024 * 1024
+
+func parseParallelism(parallelism int) (int, error) {
+	if parallelism < 0 {
+		return 0, fmt.Errorf("invalid parallelism (%d), it has to be a positive number or 0 for the number of CPUs", parallelism)
+	}
+	if parallelism == 0 {
+		return runtime.NumCPU(), nil
+	}
+	return parallelism, nil
+}
+
+// compressedEntry is a regular file compressed ahead of being written to the archive.
+type compressedEntry struct {
+	header *zip.FileHeader
+	data   *spool
+	sha256 string
+	err    error
+	done   chan struct{}
+}
+
+// zipCompressor compresses the regular files on a bounded pool of workers, ahead of the writer.
+// At most window entries are compressed or waiting to be written at a time, which bounds the memory
+// and the temporary disk space used. The writer takes the entries in the original order,
+// so the archive is identical to the one written sequentially.
+type zipCompressor struct {
+	archive *zipArchive
+	temps   *tempFiles
+	entries map[string]*compressedEntry
+	window  chan struct{}
+	workers chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newZIPCompressor(archive *zipArchive, parallelism int, temps *tempFiles) *zipCompressor {
+	return &zipCompressor{
+		archive: archive,
+		temps:   temps,
+		entries: map[string]*compressedEntry{},
+		window:  make(chan struct{}, 2*parallelism),
+		workers: make(chan struct{}, parallelism),
+		stop:    make(chan struct{}),
+	}
+}
+
+// start schedules the compression of the regular files among the entries.
+// The headers are prepared in advance, the same way as the sequential writer would.
+func (c *zipCompressor) start(entries []archiveEntry) error {
+	type job struct {
+		entry      archiveEntry
+		compressed *compressedEntry
+	}
+	var jobs []job
+	for _, entry := range entries {
+		if !entry.info.Mode().IsRegular() {
+			continue
+		}
+
+		header, err := c.archive.fileHeader(entry)
+		if err != nil {
+			return err
+		}
+
+		compressed := &compressedEntry{header: header, done: make(chan struct{})}
+		c.entries[entry.name] = compressed
+		jobs = append(jobs, job{entry: entry, compressed: compressed})
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		for _, job := range jobs {
+			select {
+			case c.window <- struct{}{}:
+			case <-c.stop:
+				return
+			}
+			select {
+			case c.workers <- struct{}{}:
+			case <-c.stop:
+				return
+			}
+
+			c.wg.Add(1)
+			go func(entry archiveEntry, compressed *compressedEntry) {
+				defer c.wg.Done()
+				defer func() { <-c.workers }()
+				defer close(compressed.done)
+				compressed.err = c.compress(entry, compressed)
+			}(job.entry, job.compressed)
+		}
+	}()
+	return nil
+}
+
+func (c *zipCompressor) compress(entry archiveEntry, compressed *compressedEntry) error {
+	a := c.archive
+	level := a.levels.levelFor(entry.name)
+	method := prepareRawZIPHeader(compressed.header, level, a.encryption)
+
+	compressed.data = &spool{temps: c.temps}
+	hasher := newContentHasher(a.hashFiles)
+	err := encodeZIPEntry(compressed.data, compressed.header, method, level, a.password, a.encryption, func(w io.Writer) error {
+		return copyFileTo(a.progress.sourceWriter(hasher.writer(w)), entry.pth)
+	})
+	compressed.sha256 = hasher.sum()
+	return err
+}
+
+// write writes the compressed entry to the archive, waiting for its compression to finish.
+// It returns false if the entry was not scheduled for compression.
+func (c *zipCompressor) write(entry archiveEntry) (*compressedEntry, bool, error) {
+	compressed, ok := c.entries[entry.name]
+	if !ok {
+		return nil, false, nil
+	}
+	delete(c.entries, entry.name)
+
+	<-compressed.done
+	defer func() { <-c.window }()
+	defer compressed.data.remove()
+	if compressed.err != nil {
+		return nil, true, compressed.err
+	}
+
+	w, err := c.archive.w.CreateRaw(compressed.header)
+	if err != nil {
+		return nil, true, err
+	}
+	r, err := compressed.data.reader()
+	if err != nil {
+		return nil, true, err
+	}
+	_, err = io.Copy(w, r)
+	return compressed, true, err
+}
+
+// close stops the scheduling, waits for the running workers and removes the compressed entries not written.
+func (c *zipCompressor) close() {
+	close(c.stop)
+	c.wg.Wait()
+	for _, compressed := range c.entries {
+		if compressed.data != nil {
+			compressed.data.remove()
+		}
+	}
+}
+
+// spool keeps the written data in memory up to spoolMemoryLimit, then in a temporary file.
+type spool struct {
+	temps *tempFiles
+	buf   bytes.Buffer
+	file  *os.File
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) > spoolMemoryLimit {
+		f, err := os.CreateTemp("", "zip-entry-*.tmp")
+		if err != nil {
+			return 0, err
+		}
+		s.temps.add(f.Name())
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	if s.file != nil {
+		return s.file.Write(p)
+	}
+	return s.buf.Write(p)
+}
+
+// reader returns the written data from the beginning.
+func (s *spool) reader() (io.Reader, error) {
+	if s.file == nil {
+		return &s.buf, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+func (s *spool) remove() {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return
+	}
+	if err := s.file.Close(); err != nil {
+		log.Warnf("Failed to close %s: %s", s.file.Name(), err)
+	}
+	removeTempFile(s.file.Name())
+	s.file = nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// progressReporter periodically logs the progress of writing the archive, compared to the totals of the collected entries.
+// A nil reporter reports nothing.
+type progressReporter struct {
+	totalEntries int64
+	totalBytes   int64
+	interval     time.Duration
+
+	entries  atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+
+	started time.Time
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newProgressReporter returns a reporter for the entries, the progress is logged in every interval.
+// A zero interval disables the periodic lines, only the summary is logged.
+func newProgressReporter(entries []archiveEntry, interval time.Duration) *progressReporter {
+	p := &progressReporter{totalEntries: int64(len(entries)), interval: interval}
+	for _, entry := range entries {
+		if entry.info.Mode().IsRegular() {
+			p.totalBytes += entry.info.Size()
+		}
+	}
+	return p
+}
+
+// start starts logging the progress periodically.
+func (p *progressReporter) start() {
+	if p == nil {
+		return
+	}
+	p.started = time.Now()
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	if p.interval <= 0 {
+		close(p.done)
+		return
+	}
+
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.logProgress()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// finish stops logging the progress, then logs the summary if the archive is complete.
+func (p *progressReporter) finish(complete bool) {
+	if p == nil || p.stop == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+
+	if !complete {
+		return
+	}
+	elapsed := time.Since(p.started)
+	bytesIn, bytesOut := p.bytesIn.Load(), p.bytesOut.Load()
+	ratio := "n/a"
+	if bytesIn > 0 {
+		ratio = fmt.Sprintf("%.1f%%", 100*float64(bytesOut)/float64(bytesIn))
+	}
+	log.Printf("Archived %d entries, %s into %s (compression ratio %s) in %s, %s",
+		p.entries.Load(), formatBytes(bytesIn), formatBytes(bytesOut), ratio, elapsed.Round(time.Millisecond), formatThroughput(bytesIn, elapsed))
+}
+
+func (p *progressReporter) logProgress() {
+	elapsed := time.Since(p.started)
+	bytesIn, bytesOut := p.bytesIn.Load(), p.bytesOut.Load()
+
+	percent := 100.0
+	if p.totalBytes > 0 {
+		percent = 100 * float64(bytesIn) / float64(p.totalBytes)
+	}
+
+	eta := "unknown"
+	if bytesIn > 0 && bytesIn <= p.totalBytes {
+		remaining := time.Duration(float64(elapsed) * float64(p.totalBytes-bytesIn) / float64(bytesIn))
+		eta = remaining.Round(time.Second).String()
+	}
+
+	log.Printf("Progress: %d/%d entries, %s/%s read (%.0f%%), %s written, %s, ETA %s",
+		p.entries.Load(), p.totalEntries, formatBytes(bytesIn), formatBytes(p.totalBytes), percent,
+		formatBytes(bytesOut), formatThroughput(bytesIn, elapsed), eta)
+}
+
+// entryDone counts an entry written to the archive.
+func (p *progressReporter) entryDone() {
+	if p != nil {
+		p.entries.Add(1)
+	}
+}
+
+// sourceWriter returns a writer which counts the bytes of the source files written through it.
+func (p *progressReporter) sourceWriter(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, count: &p.bytesIn}
+}
+
+// archiveWriter returns a writer which counts the bytes of the archive written through it.
+func (p *progressReporter) archiveWriter(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, count: &p.bytesOut}
+}
+
+type progressWriter struct {
+	w     io.Writer
+	count *atomic.Int64
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.count.Add(int64(n))
+	return n, err
+}
+
+// formatBytes formats the size with a binary unit, for example 1.5 MiB.
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+func formatThroughput(size int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "n/a"
+	}
+	return formatBytes(int64(float64(size)/elapsed.Seconds())) + "/s"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultReproducibleModTime is used as the modification time of every entry in reproducible mode,
+// if SOURCE_DATE_EPOCH is not set. It is the earliest time which can be stored in a ZIP archive.
+var defaultReproducibleModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// reproducibleModTime returns the modification time of the entries in reproducible mode,
+// honouring the SOURCE_DATE_EPOCH environment variable (https://reproducible-builds.org/specs/source-date-epoch/).
+func reproducibleModTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return defaultReproducibleModTime, nil
+	}
+
+	seconds, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH (%s): %s", epoch, err)
+	}
+
+	modTime := time.Unix(seconds, 0).UTC()
+	if modTime.Before(defaultReproducibleModTime) {
+		return defaultReproducibleModTime, nil
+	}
+	return modTime, nil
+}
+
+// normalizeEntries sorts the entries by name and hides the metadata which differs between runs:
+// the modification time, the permissions beyond the executable bit and the owner.
+func normalizeEntries(entries []archiveEntry, modTime time.Time) []archiveEntry {
+	normalized := make([]archiveEntry, len(entries))
+	for i, entry := range entries {
+		entry.info = normalizedFileInfo{FileInfo: entry.info, modTime: modTime}
+		normalized[i] = entry
+	}
+
+	sort.SliceStable(normalized, func(i, j int) bool {
+		return normalized[i].name < normalized[j].name
+	})
+	return normalized
+}
+
+// normalizedFileInfo overrides the metadata of a file which would make the archive differ between runs.
+type normalizedFileInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (i normalizedFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+// Mode returns 0755 for directories and executables, 0644 for other files and 0777 for symlinks.
+func (i normalizedFileInfo) Mode() os.FileMode {
+	mode := i.FileInfo.Mode()
+	switch {
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case mode&0111 != 0:
+		return mode.Type() | 0755
+	default:
+		return mode.Type() | 0644
+	}
+}
+
+// Sys returns nil, so the owner of the file is not stored in the archive.
+func (i normalizedFileInfo) Sys() interface{} {
+	return nil
+}
+
+// msDOSDateTime converts the time to the MS-DOS date and time format used by the ZIP headers.
+// Like CreateHeader, it keeps the time zone of t, times before 1980 are stored as 1980-01-01.
+func msDOSDateTime(t time.Time) (uint16, uint16) {
+	if t.Before(defaultReproducibleModTime) {
+		t = defaultReproducibleModTime
+	}
+
+	date := uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	tm := uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, tm
+}
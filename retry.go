@@ -0,0 +1,22 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// retry calls fn until it succeeds, it returns an error which is not retryable, or it is retried maxRetries times.
+// The wait before the first retry is backoff, it is doubled before every further retry.
+func retry(maxRetries int, backoff time.Duration, fn func() (retryable bool, err error)) error {
+	for attempt := 0; ; attempt++ {
+		retryable, err := fn()
+		if err == nil || !retryable || attempt >= maxRetries {
+			return err
+		}
+
+		log.Warnf("Attempt %d failed: %s, retrying in %s", attempt+1, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
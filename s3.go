@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// s3MinPartSize is the minimum size of a multipart upload part, except the last one.
+	s3MinPartSize = 5 << 20
+	// s3MaxParts is the maximum number of parts of a multipart upload.
+	s3MaxParts = 10000
+	// s3RetryBackoff is the wait before the first retry of a failed request.
+	s3RetryBackoff = time.Second
+)
+
+// s3Upload uploads the archive to an S3 compatible object storage.
+type s3Upload struct {
+	// endpoint is the scheme and host of the service, the bucket is addressed in the path if pathStyle is set,
+	// otherwise as a subdomain of the endpoint.
+	endpoint    *url.URL
+	pathStyle   bool
+	bucket      string
+	region      string
+	keyTemplate string
+	creds       awsCredentials
+	partSize    int64
+	maxRetries  int
+	client      *http.Client
+}
+
+// parseS3Upload validates the S3 upload inputs, it returns nil if no bucket is set.
+// Without an endpoint the AWS endpoint of the region is used, a custom endpoint (for example MinIO) is addressed path-style.
+func parseS3Upload(cfg config) (*s3Upload, error) {
+	if cfg.S3Bucket == "" {
+		return nil, nil
+	}
+
+	u := &s3Upload{
+		bucket:      cfg.S3Bucket,
+		region:      cfg.S3Region,
+		keyTemplate: cfg.S3Key,
+		creds: awsCredentials{
+			accessKeyID:     string(cfg.S3AccessKeyID),
+			secretAccessKey: string(cfg.S3SecretAccessKey),
+			sessionToken:    string(cfg.S3SessionToken),
+		},
+		maxRetries: cfg.S3MaxRetries,
+		client:     &http.Client{},
+	}
+	if u.region == "" {
+		u.region = "us-east-1"
+	}
+	if u.keyTemplate == "" {
+		u.keyTemplate = "{name}"
+	}
+	if u.creds.accessKeyID == "" || u.creds.secretAccessKey == "" {
+		return nil, fmt.Errorf("the access key ID and the secret access key are required for the S3 upload")
+	}
+	if u.maxRetries < 0 {
+		return nil, fmt.Errorf("invalid S3 max retries (%d), it has to be a positive number or 0", u.maxRetries)
+	}
+
+	u.partSize = 16 << 20
+	if cfg.S3PartSize != "" {
+		size, ok := parseSize(cfg.S3PartSize)
+		if !ok || size < s3MinPartSize {
+			return nil, fmt.Errorf("invalid S3 part size (%s), it has to be at least 5M", cfg.S3PartSize)
+		}
+		u.partSize = size
+	}
+
+	if cfg.S3Endpoint == "" {
+		u.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", u.region)}
+		return u, nil
+	}
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint (%s), it has to be an http or https URL", cfg.S3Endpoint)
+	}
+	u.endpoint = &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host}
+	u.pathStyle = true
+	return u, nil
+}
+
+// key returns the object key of the file, the {name} placeholder of the template is replaced with the file name.
+func (u *s3Upload) key(pth string) string {
+	key := strings.ReplaceAll(u.keyTemplate, "{name}", filepath.Base(pth))
+	return strings.TrimPrefix(key, "/")
+}
+
+// objectURL returns the URL of the object, with the query parameters if given.
+func (u *s3Upload) objectURL(key string, query url.Values) *url.URL {
+	target := *u.endpoint
+	if u.pathStyle {
+		target.Path = "/" + u.bucket + "/" + key
+	} else {
+		target.Host = u.bucket + "." + target.Host
+		target.Path = "/" + key
+	}
+	target.RawPath = awsURIEncode(target.Path, false)
+	target.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	return &target
+}
+
+// uploadArchive uploads the archive, or every part of it if it is split, and returns the URLs of the objects.
+func (u *s3Upload) uploadArchive(destination string, result archiveResult) ([]string, error) {
+	pths := []string{destination}
+	if len(result.parts) > 0 {
+		pths = nil
+		for _, part := range result.parts {
+			pths = append(pths, part.pth)
+		}
+	}
+
+	log.Printf("")
+	log.Infof("Uploading to S3 bucket %s", u.bucket)
+
+	var urls []string
+	for _, pth := range pths {
+		key := u.key(pth)
+		started := time.Now()
+		size, err := u.upload(pth, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s: %s", pth, err)
+		}
+		objectURL := u.objectURL(key, nil).String()
+		log.Donef("Uploaded %s (%s) to %s in %s", filepath.Base(pth), formatBytes(size), objectURL, time.Since(started).Round(time.Millisecond))
+		urls = append(urls, objectURL)
+	}
+	return urls, nil
+}
+
+// upload uploads the file to the key with a single request if it fits into a part, otherwise with a multipart upload.
+// The file is streamed from the disk, one part at a time.
+func (u *s3Upload) upload(pth, key string) (int64, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	if size <= u.partSize {
+		_, _, err := u.send(http.MethodPut, u.objectURL(key, nil), io.NewSectionReader(f, 0, size))
+		return size, err
+	}
+	return size, u.multipartUpload(f, size, key)
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+func (u *s3Upload) multipartUpload(f *os.File, size int64, key string) error {
+	partSize := u.partSize
+	if (size+partSize-1)/partSize > s3MaxParts {
+		// Grow the parts to fit the limit, rounded up to MiB.
+		partSize = ((size/s3MaxParts)>>20 + 1) << 20
+	}
+
+	_, body, err := u.send(http.MethodPost, u.objectURL(key, url.Values{"uploads": {""}}), nil)
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %s", err)
+	}
+	var initiated initiateMultipartUploadResult
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("invalid multipart upload response: %s", body)
+	}
+	uploadID := initiated.UploadID
+
+	abort := func(err error) error {
+		if _, _, aerr := u.send(http.MethodDelete, u.objectURL(key, url.Values{"uploadId": {uploadID}}), nil); aerr != nil {
+			log.Warnf("Failed to abort multipart upload: %s", aerr)
+		}
+		return err
+	}
+
+	var completed completeMultipartUpload
+	parts := int((size + partSize - 1) / partSize)
+	for number := 1; number <= parts; number++ {
+		offset := int64(number-1) * partSize
+		section := io.NewSectionReader(f, offset, min(partSize, size-offset))
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		header, _, err := u.send(http.MethodPut, u.objectURL(key, query), section)
+		if err != nil {
+			return abort(fmt.Errorf("failed to upload part %d/%d: %s", number, parts, err))
+		}
+		completed.Parts = append(completed.Parts, completedPart{PartNumber: number, ETag: header.Get("ETag")})
+		log.Printf("Uploaded part %d/%d", number, parts)
+	}
+
+	data, err := xml.Marshal(completed)
+	if err != nil {
+		return abort(err)
+	}
+	if _, _, err := u.send(http.MethodPost, u.objectURL(key, url.Values{"uploadId": {uploadID}}), io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))); err != nil {
+		return abort(fmt.Errorf("failed to complete multipart upload: %s", err))
+	}
+	return nil
+}
+
+// s3Error is the error response of the service.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// send sends a signed request with the body, retrying it on network errors, throttling and server errors.
+// It returns the headers and the body of the successful response.
+func (u *s3Upload) send(method string, target *url.URL, body *io.SectionReader) (http.Header, []byte, error) {
+	payloadHash := emptyPayloadHash
+	if body != nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, io.NewSectionReader(body, 0, body.Size())); err != nil {
+			return nil, nil, err
+		}
+		payloadHash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	var header http.Header
+	var data []byte
+	err := retry(u.maxRetries, s3RetryBackoff, func() (bool, error) {
+		var reader io.Reader = http.NoBody
+		if body != nil && body.Size() > 0 {
+			reader = io.NewSectionReader(body, 0, body.Size())
+		}
+		req, err := http.NewRequest(method, target.String(), reader)
+		if err != nil {
+			return false, err
+		}
+		if body != nil {
+			req.ContentLength = body.Size()
+		}
+		signV4(req, u.creds, u.region, "s3", payloadHash, time.Now())
+
+		resp, err := u.client.Do(req)
+		if err != nil {
+			return true, err
+		}
+		defer func() {
+			if err := resp.Body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return true, err
+		}
+
+		// Completing a multipart upload can fail with a 200 OK status, the error is in the body.
+		var s3Err s3Error
+		hasError := xml.Unmarshal(respBody, &s3Err) == nil && s3Err.Code != ""
+		if resp.StatusCode >= 300 || hasError {
+			retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode < 300
+			if hasError {
+				return retryable, fmt.Errorf("%s %s: %s: %s (%s)", method, target.Path, resp.Status, s3Err.Code, s3Err.Message)
+			}
+			return retryable, fmt.Errorf("%s %s: %s", method, target.Path, resp.Status)
+		}
+
+		header, data = resp.Header, respBody
+		return false, nil
+	})
+	return header, data, err
+}
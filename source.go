@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// archiveEntry is a file, directory or symlink on the disk and its name in the archive.
+type archiveEntry struct {
+	pth  string
+	name string
+	info os.FileInfo
+}
+
+// splitList splits a list input at newlines and pipes, empty items are dropped.
+func splitList(value string) []string {
+	var items []string
+	for _, line := range strings.Split(value, "\n") {
+		for _, item := range strings.Split(line, "|") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// resolveSources expands the glob patterns in the given source paths and checks that every other path exists.
+// Paths which are inside an other resolved directory are dropped, as they are archived with that directory.
+func resolveSources(sourcePaths []string) ([]string, error) {
+	if len(sourcePaths) == 0 {
+		return nil, fmt.Errorf("no source path provided")
+	}
+
+	var resolved []string
+	seen := map[string]bool{}
+	for _, sourcePath := range sourcePaths {
+		var matches []string
+		if hasGlobMeta(sourcePath) {
+			var err error
+			if matches, err = expandGlob(sourcePath); err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("source pattern (%s) does not match any file", sourcePath)
+			}
+		} else {
+			if _, err := os.Lstat(sourcePath); err != nil {
+				if os.IsNotExist(err) {
+					return nil, fmt.Errorf("source (%s) not exist", sourcePath)
+				}
+				return nil, err
+			}
+			matches = []string{sourcePath}
+		}
+
+		for _, match := range matches {
+			match = filepath.Clean(match)
+			if !seen[match] {
+				seen[match] = true
+				resolved = append(resolved, match)
+			}
+		}
+	}
+
+	var sources []string
+	for _, pth := range resolved {
+		if !hasResolvedAncestor(pth, seen) {
+			sources = append(sources, pth)
+		}
+	}
+
+	names := map[string]string{}
+	for _, pth := range sources {
+		name := filepath.Base(pth)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("sources (%s) and (%s) would both be stored as %s in the archive", other, pth, name)
+		}
+		names[name] = pth
+	}
+
+	return sources, nil
+}
+
+func hasResolvedAncestor(pth string, resolved map[string]bool) bool {
+	for dir := filepath.Dir(pth); ; dir = filepath.Dir(dir) {
+		if resolved[dir] {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// archiveBaseName returns the name of the archive which is used if the destination is a directory.
+func archiveBaseName(sources []string) string {
+	if len(sources) == 1 {
+		return filepath.Base(sources[0])
+	}
+	return "archive"
+}
+
+// archiveLayout configures the names of the entries in the archive.
+type archiveLayout struct {
+	// contentOnly stores the contents of the directory sources without the wrapping directory.
+	contentOnly bool
+	// root is the directory in the archive which contains every entry, empty for the root of the archive.
+	root string
+}
+
+// parseArchiveRoot validates the in-archive root directory and converts it to a slash separated relative path.
+func parseArchiveRoot(root string) (string, error) {
+	root = strings.Trim(filepath.ToSlash(strings.TrimSpace(root)), "/")
+	if root == "" {
+		return "", nil
+	}
+
+	root = path.Clean(root)
+	if root == "." || root == ".." || strings.HasPrefix(root, "../") {
+		return "", fmt.Errorf("invalid archive root (%s): should be a relative path inside the archive", root)
+	}
+	return root, nil
+}
+
+// collectEntries walks the sources and returns the entries to archive which pass the filter.
+// Every source is stored in the root of the archive under its base name, unless the layout says otherwise.
+// The symlinks are stored, followed or skipped according to the symlink mode.
+func collectEntries(sources []string, filter *entryFilter, layout archiveLayout, links symlinkMode) ([]archiveEntry, error) {
+	walker := newSymlinkWalker(links)
+	var entries []archiveEntry
+	names := map[string]string{}
+	for _, source := range sources {
+		sourceEntries, err := collectSourceEntries(source, filter, layout, walker)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range sourceEntries {
+			if other, ok := names[entry.name]; ok {
+				return nil, fmt.Errorf("%s and %s would both be stored as %s in the archive", other, entry.pth, entry.name)
+			}
+			names[entry.name] = entry.pth
+		}
+		entries = append(entries, sourceEntries...)
+	}
+	if walker.skipped > 0 {
+		log.Printf("%d symlinks skipped", walker.skipped)
+	}
+	return entries, nil
+}
+
+func collectSourceEntries(source string, filter *entryFilter, layout archiveLayout, walker *symlinkWalker) ([]archiveEntry, error) {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return nil, err
+	}
+	if walker.mode.follows() {
+		if info, err = os.Stat(source); err != nil {
+			return nil, fmt.Errorf("failed to follow symlink (%s): %s", source, err)
+		}
+	}
+
+	baseDir := filepath.Dir(source)
+	if layout.contentOnly && info.IsDir() {
+		baseDir = source
+	}
+	// Filter patterns are matched relative to the source directory, or to the parent directory of a file source.
+	filterRoot := source
+	if !info.IsDir() {
+		filterRoot = baseDir
+	}
+
+	var entries []archiveEntry
+	var rels []string
+	if err := walker.walk(source, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(filterRoot, pth)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." {
+			if rule := filter.excludedBy(rel, info.IsDir()); rule != nil {
+				rule.skipped++
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		name, err := filepath.Rel(baseDir, pth)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			// The source directory itself in content only mode.
+			return nil
+		}
+
+		entries = append(entries, archiveEntry{pth: pth, name: path.Join(layout.root, filepath.ToSlash(name)), info: info})
+		rels = append(rels, rel)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return filter.filter(entries, rels), nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// expandGlob returns the paths matching the pattern in lexical order.
+// Besides the filepath.Match syntax, a `**` path segment matches zero or more directories.
+func expandGlob(pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	segments := strings.Split(pattern, "/")
+
+	// The walk starts from the longest leading part of the pattern without glob meta characters.
+	i := 0
+	for i < len(segments)-1 && !hasGlobMeta(segments[i]) {
+		i++
+	}
+	root := strings.Join(segments[:i], "/")
+	switch {
+	case root == "" && strings.HasPrefix(pattern, "/"):
+		root = "/"
+	case root == "":
+		root = "."
+	}
+	relPattern := strings.Join(segments[i:], "/")
+	if _, err := path.Match(strings.Replace(relPattern, "**", "*", -1), ""); err != nil {
+		return nil, fmt.Errorf("invalid source pattern (%s): %s", pattern, err)
+	}
+
+	if _, err := os.Lstat(filepath.FromSlash(root)); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var matches []string
+	if err := filepath.Walk(filepath.FromSlash(root), func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(filepath.FromSlash(root), pth)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		if matchGlob(relPattern, filepath.ToSlash(rel)) {
+			matches = append(matches, pth)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchGlob reports whether the slash separated name matches the pattern.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
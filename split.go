@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// splitMode is the way an archive exceeding the split size is split into parts.
+type splitMode string
+
+const (
+	// splitZIP creates a standard multi-volume split ZIP archive (name.z01, name.z02, ..., name.zip).
+	splitZIP splitMode = "zip"
+	// splitChunks cuts the archive into byte chunks (name.zip.001, name.zip.002, ...),
+	// which can be reassembled by concatenating them.
+	splitChunks splitMode = "chunks"
+)
+
+// minSplitSize is the smallest supported part size, the same as the minimum of the zip command.
+const minSplitSize = 64 * 1024
+
+// maxChunks is the largest number of chunks, so the names of the chunks keep three digits
+// and name.zip.0* lists them in order.
+const maxChunks = 999
+
+const (
+	zipSplitSignature       = 0x08074b50
+	zipLocalHeaderSignature = 0x04034b50
+	zipCentralDirSignature  = 0x02014b50
+	zipEOCDSignature        = 0x06054b50
+	zip64EOCDSignature      = 0x06064b50
+	zip64LocatorSignature   = 0x07064b50
+	zip64ExtraID            = 0x0001
+
+	zipLocalHeaderLen  = 30
+	zipCentralDirLen   = 46
+	zipEOCDLen         = 22
+	zip64EOCDLen       = 56
+	zip64LocatorLen    = 20
+	zipMaxCommentLen   = 0xffff
+	uint16max          = 0xffff
+	zipMaxVolumeNumber = uint16max - 1
+)
+
+// archivePart is a file of a split archive.
+type archivePart struct {
+	pth       string
+	size      int64
+	sha256    string
+	checksums []*checksum
+}
+
+// parseSplitSize parses the split size, an empty size disables splitting.
+func parseSplitSize(size string) (int64, error) {
+	if strings.TrimSpace(size) == "" {
+		return 0, nil
+	}
+
+	value, ok := parseSize(size)
+	if !ok {
+		return 0, fmt.Errorf("invalid split size (%s), use a number of bytes optionally followed by K, M or G, for example 2G", size)
+	}
+	if value < minSplitSize {
+		return 0, fmt.Errorf("split size (%s) is smaller than the minimum (64K)", size)
+	}
+	return value, nil
+}
+
+// parseSize parses a size in bytes, optionally followed by a K, M or G (1024 based) unit, for example 2G or 500MB.
+func parseSize(size string) (int64, bool) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || value <= 0 {
+		return 0, false
+	}
+	return value * multiplier, true
+}
+
+func parseSplitMode(mode string, format archiveFormat) (splitMode, error) {
+	switch m := splitMode(mode); m {
+	case splitZIP:
+		if format != formatZIP {
+			return "", fmt.Errorf("split ZIP volumes can not be created for the %s format, use the chunks split mode", format)
+		}
+		return m, nil
+	case splitChunks:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid split mode (%s)", mode)
+	}
+}
+
+// splitArchive splits the complete archive at pth into parts of at most opts.splitSize bytes next to destination.
+// The parts are written to temporary files, which are moved in place only if every part is written.
+func splitArchive(pth, destination string, opts archiveOptions, temps *tempFiles) ([]archivePart, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	var partPth func(i int, last bool) string
+	archiveHash := sha256.New()
+	w := &partWriter{destination: destination, size: opts.splitSize, maxParts: zipMaxVolumeNumber + 1, algorithms: opts.checksums, temps: temps}
+	if opts.splitMode == splitZIP {
+		partPth = func(i int, last bool) string {
+			if last {
+				return destination
+			}
+			return fmt.Sprintf("%s.z%02d", strings.TrimSuffix(destination, filepath.Ext(destination)), i+1)
+		}
+		err = writeZIPVolumes(f, w)
+	} else {
+		partPth = func(i int, last bool) string {
+			return fmt.Sprintf("%s.%03d", destination, i+1)
+		}
+		w.maxParts = maxChunks
+		_, err = io.Copy(io.MultiWriter(w, archiveHash), f)
+	}
+	if err == nil {
+		err = w.closePart()
+	}
+	if err != nil {
+		w.removeParts()
+		return nil, err
+	}
+
+	// The parts of an overwritten archive would be joined together with the new parts.
+	if err := removeArchive(destination, opts.splitMode); err != nil {
+		w.removeParts()
+		return nil, fmt.Errorf("failed to remove the existing archive: %s", err)
+	}
+
+	for i := range w.parts {
+		part := &w.parts[i]
+		tmpPth := part.pth
+		part.pth = partPth(i, i == len(w.parts)-1)
+		if err := os.Rename(tmpPth, part.pth); err != nil {
+			w.removeParts()
+			return nil, err
+		}
+	}
+
+	if opts.splitMode == splitChunks {
+		pth, err := writePartsManifest(destination, hex.EncodeToString(archiveHash.Sum(nil)), w.parts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write parts manifest: %s", err)
+		}
+		log.Printf("Reassembly manifest written to %s", pth)
+	}
+	return w.parts, nil
+}
+
+// existingParts returns the part files of a split archive at destination which already exist,
+// name.z01, name.z02, ... in zip split mode and name.zip.001, name.zip.002, ... in chunks split mode.
+func existingParts(destination string, mode splitMode) ([]string, error) {
+	prefix := filepath.Base(destination) + "."
+	if mode == splitZIP {
+		prefix = strings.TrimSuffix(filepath.Base(destination), filepath.Ext(destination)) + ".z"
+	}
+
+	dir := filepath.Dir(destination)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []string
+	for _, entry := range entries {
+		number := strings.TrimPrefix(entry.Name(), prefix)
+		if number != entry.Name() && len(number) >= 2 && strings.Trim(number, "0123456789") == "" {
+			parts = append(parts, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return parts, nil
+}
+
+// removeArchive removes the archive at destination together with the parts and the reassembly manifest
+// of a split archive at destination.
+func removeArchive(destination string, mode splitMode) error {
+	if err := removeParts(destination, mode); err != nil {
+		return err
+	}
+	if err := os.Remove(destination); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeParts removes the parts and the reassembly manifest of a split archive at destination.
+func removeParts(destination string, mode splitMode) error {
+	parts, err := existingParts(destination, mode)
+	if err != nil {
+		return err
+	}
+	for _, pth := range append(parts, destination+".parts.json") {
+		if err := os.Remove(pth); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		log.Printf("Removed %s of the existing archive", pth)
+	}
+	return nil
+}
+
+// partWriter writes the data into consecutive part files of a fixed maximum size,
+// computing the checksums of every part.
+type partWriter struct {
+	destination string
+	size        int64
+	maxParts    int
+	algorithms  []string
+	temps       *tempFiles
+
+	parts   []archivePart
+	current *os.File
+	out     io.Writer
+	hash    hash.Hash
+	written int64
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if w.current == nil || w.written == w.size {
+			if err := w.nextPart(); err != nil {
+				return n, err
+			}
+		}
+
+		chunk := p[:min(int64(len(p)), w.size-w.written)]
+		written, err := w.out.Write(chunk)
+		w.written += int64(written)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+	return n, nil
+}
+
+// keep makes sure that the next n bytes are written to the same part, starting a new part if needed.
+func (w *partWriter) keep(n int64) error {
+	if n > w.size {
+		return fmt.Errorf("a %d bytes long ZIP record does not fit into a %d bytes long volume", n, w.size)
+	}
+	if w.current == nil || w.written+n > w.size {
+		return w.nextPart()
+	}
+	return nil
+}
+
+// position returns the number of the current part and the offset of the next byte in it.
+func (w *partWriter) position() (int, int64) {
+	if w.current == nil || w.written == w.size {
+		return len(w.parts), 0
+	}
+	return len(w.parts) - 1, w.written
+}
+
+func (w *partWriter) nextPart() error {
+	if err := w.closePart(); err != nil {
+		return err
+	}
+	if len(w.parts) >= w.maxParts {
+		return fmt.Errorf("the archive would be split into more than %d parts, increase the split size", w.maxParts)
+	}
+
+	// The final name of the part is known only when every part is written.
+	tmpPth, err := createTempFileNextTo(fmt.Sprintf("%s.part%d", w.destination, len(w.parts)+1))
+	if err != nil {
+		return err
+	}
+	w.temps.add(tmpPth)
+
+	f, err := os.Create(tmpPth)
+	if err != nil {
+		return err
+	}
+
+	checksums := newChecksums(w.algorithms)
+	w.hash = sha256.New()
+	writers := []io.Writer{f, w.hash}
+	for _, c := range checksums {
+		writers = append(writers, c.hash)
+	}
+
+	w.parts = append(w.parts, archivePart{pth: tmpPth, checksums: checksums})
+	w.current, w.out, w.written = f, io.MultiWriter(writers...), 0
+	return nil
+}
+
+func (w *partWriter) closePart() error {
+	if w.current == nil {
+		return nil
+	}
+	part := &w.parts[len(w.parts)-1]
+	part.size = w.written
+	part.sha256 = hex.EncodeToString(w.hash.Sum(nil))
+	err := w.current.Close()
+	w.current, w.out = nil, nil
+	return err
+}
+
+func (w *partWriter) removeParts() {
+	if err := w.closePart(); err != nil {
+		log.Warnf("Failed to close part: %s", err)
+	}
+	for _, part := range w.parts {
+		removeTempFile(part.pth)
+	}
+}
+
+// zipEnd is the end of the central directory, together with its ZIP64 counterpart if present.
+type zipEnd struct {
+	eocd      []byte
+	zip64EOCD []byte
+	cdOffset  int64
+	cdSize    int64
+	entries   int64
+}
+
+// writeZIPVolumes rewrites the archive as a multi-volume split ZIP archive:
+// the disk numbers and the offsets of the local headers, the central directory and the end records
+// are made relative to the volume containing them. Headers and records are never split between volumes,
+// only the file contents are.
+func writeZIPVolumes(f *os.File, w *partWriter) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	end, err := readZIPEnd(f, 0, info.Size())
+	if err != nil {
+		return err
+	}
+
+	cd := make([]byte, end.cdSize)
+	if _, err := f.ReadAt(cd, end.cdOffset); err != nil {
+		return fmt.Errorf("failed to read central directory: %s", err)
+	}
+	records, err := splitCentralDirectory(cd, end.entries)
+	if err != nil {
+		return err
+	}
+
+	type localHeader struct {
+		record int
+		offset int64
+		size   int64
+	}
+	headers := make([]localHeader, len(records))
+	for i, record := range records {
+		offset, err := centralDirRecordOffset(record)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, zipLocalHeaderLen)
+		if _, err := f.ReadAt(buf, offset); err != nil {
+			return fmt.Errorf("failed to read local header: %s", err)
+		}
+		if binary.LittleEndian.Uint32(buf) != zipLocalHeaderSignature {
+			return errors.New("invalid local header signature")
+		}
+		size := zipLocalHeaderLen + int64(binary.LittleEndian.Uint16(buf[26:])) + int64(binary.LittleEndian.Uint16(buf[28:]))
+		headers[i] = localHeader{record: i, offset: offset, size: size}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].offset < headers[j].offset
+	})
+
+	signature := make([]byte, 4)
+	binary.LittleEndian.PutUint32(signature, zipSplitSignature)
+	if _, err := w.Write(signature); err != nil {
+		return err
+	}
+
+	// Copy the local headers and the contents, the contents may span multiple volumes.
+	var pos int64
+	for _, header := range headers {
+		if _, err := io.Copy(w, io.NewSectionReader(f, pos, header.offset-pos)); err != nil {
+			return err
+		}
+		if err := w.keep(header.size); err != nil {
+			return err
+		}
+		disk, offset := w.position()
+		if err := setCentralDirRecordPosition(records[header.record], disk, offset); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(f, header.offset, header.size)); err != nil {
+			return err
+		}
+		pos = header.offset + header.size
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(f, pos, end.cdOffset-pos)); err != nil {
+		return err
+	}
+
+	// Write the central directory, a record is never split between volumes.
+	cdDisk, cdOffset := -1, int64(0)
+	entriesOnDisk := map[int]int64{}
+	for _, record := range records {
+		if err := w.keep(int64(len(record))); err != nil {
+			return err
+		}
+		disk, offset := w.position()
+		if cdDisk == -1 {
+			cdDisk, cdOffset = disk, offset
+		}
+		entriesOnDisk[disk]++
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+
+	// The end records are always on the last volume.
+	endSize := int64(len(end.eocd))
+	if end.zip64EOCD != nil {
+		endSize += int64(len(end.zip64EOCD)) + zip64LocatorLen
+	}
+	if err := w.keep(endSize); err != nil {
+		return err
+	}
+	lastDisk, endOffset := w.position()
+	if cdDisk == -1 {
+		cdDisk, cdOffset = lastDisk, endOffset
+	}
+
+	if end.zip64EOCD != nil {
+		zip64EOCD := end.zip64EOCD
+		binary.LittleEndian.PutUint32(zip64EOCD[16:], uint32(lastDisk))
+		binary.LittleEndian.PutUint32(zip64EOCD[20:], uint32(cdDisk))
+		binary.LittleEndian.PutUint64(zip64EOCD[24:], uint64(entriesOnDisk[lastDisk]))
+		binary.LittleEndian.PutUint64(zip64EOCD[48:], uint64(cdOffset))
+
+		locator := make([]byte, zip64LocatorLen)
+		binary.LittleEndian.PutUint32(locator[0:], zip64LocatorSignature)
+		binary.LittleEndian.PutUint32(locator[4:], uint32(lastDisk))
+		binary.LittleEndian.PutUint64(locator[8:], uint64(endOffset))
+		binary.LittleEndian.PutUint32(locator[16:], uint32(lastDisk+1))
+
+		if _, err := w.Write(append(zip64EOCD, locator...)); err != nil {
+			return err
+		}
+	}
+
+	// The fields of the end of central directory record which do not fit are stored in the ZIP64 record only.
+	eocd := end.eocd
+	putUint16Field(eocd[4:], uint64(lastDisk))
+	putUint16Field(eocd[6:], uint64(cdDisk))
+	putUint16Field(eocd[8:], uint64(entriesOnDisk[lastDisk]))
+	if binary.LittleEndian.Uint32(eocd[16:]) != uint32max {
+		binary.LittleEndian.PutUint32(eocd[16:], uint32(cdOffset))
+	}
+	_, err = w.Write(eocd)
+	return err
+}
+
+func putUint16Field(b []byte, value uint64) {
+	if binary.LittleEndian.Uint16(b) == uint16max {
+		return
+	}
+	binary.LittleEndian.PutUint16(b, uint16(value))
+}
+
+// readZIPEnd finds the end of central directory record, and the ZIP64 one if present,
+// in the part of the archive between the start and size offsets.
+func readZIPEnd(r io.ReaderAt, start, size int64) (zipEnd, error) {
+	bufSize := min(size-start, zipEOCDLen+zipMaxCommentLen)
+	buf := make([]byte, bufSize)
+	if _, err := r.ReadAt(buf, size-bufSize); err != nil {
+		return zipEnd{}, err
+	}
+
+	pos := -1
+	for i := len(buf) - zipEOCDLen; i >= 0; i-- {
+		if binary.LittleEndian.Uint32(buf[i:]) == zipEOCDSignature && i+zipEOCDLen+int(binary.LittleEndian.Uint16(buf[i+20:])) == len(buf) {
+			pos = i
+			break
+		}
+	}
+	if pos == -1 {
+		return zipEnd{}, errors.New("end of central directory not found")
+	}
+
+	eocd := bytes.Clone(buf[pos:])
+	end := zipEnd{
+		eocd:     eocd,
+		entries:  int64(binary.LittleEndian.Uint16(eocd[10:])),
+		cdSize:   int64(binary.LittleEndian.Uint32(eocd[12:])),
+		cdOffset: int64(binary.LittleEndian.Uint32(eocd[16:])),
+	}
+
+	eocdOffset := size - bufSize + int64(pos)
+	if eocdOffset-start < zip64LocatorLen {
+		return end, nil
+	}
+	locator := make([]byte, zip64LocatorLen)
+	if _, err := r.ReadAt(locator, eocdOffset-zip64LocatorLen); err != nil {
+		return zipEnd{}, err
+	}
+	if binary.LittleEndian.Uint32(locator) != zip64LocatorSignature {
+		return end, nil
+	}
+
+	zip64Offset := int64(binary.LittleEndian.Uint64(locator[8:]))
+	if zip64Offset < start || eocdOffset-zip64LocatorLen-zip64Offset < zip64EOCDLen {
+		return zipEnd{}, errors.New("invalid ZIP64 end of central directory")
+	}
+	zip64EOCD := make([]byte, eocdOffset-zip64LocatorLen-zip64Offset)
+	if _, err := r.ReadAt(zip64EOCD, zip64Offset); err != nil {
+		return zipEnd{}, err
+	}
+	if binary.LittleEndian.Uint32(zip64EOCD) != zip64EOCDSignature {
+		return zipEnd{}, errors.New("invalid ZIP64 end of central directory signature")
+	}
+
+	end.zip64EOCD = zip64EOCD
+	end.entries = int64(binary.LittleEndian.Uint64(zip64EOCD[32:]))
+	end.cdSize = int64(binary.LittleEndian.Uint64(zip64EOCD[40:]))
+	end.cdOffset = int64(binary.LittleEndian.Uint64(zip64EOCD[48:]))
+	if end.cdOffset != zip64Offset-end.cdSize {
+		return zipEnd{}, errors.New("unexpected data between the central directory and its end")
+	}
+	return end, nil
+}
+
+// splitCentralDirectory returns the records of the central directory, sharing the memory of cd.
+func splitCentralDirectory(cd []byte, entries int64) ([][]byte, error) {
+	var records [][]byte
+	for i := int64(0); i < entries; i++ {
+		if len(cd) < zipCentralDirLen || binary.LittleEndian.Uint32(cd) != zipCentralDirSignature {
+			return nil, errors.New("invalid central directory record")
+		}
+		size := zipCentralDirLen + int(binary.LittleEndian.Uint16(cd[28:])) + int(binary.LittleEndian.Uint16(cd[30:])) + int(binary.LittleEndian.Uint16(cd[32:]))
+		if len(cd) < size {
+			return nil, errors.New("truncated central directory record")
+		}
+		records = append(records, cd[:size])
+		cd = cd[size:]
+	}
+	return records, nil
+}
+
+// zip64Field returns a field of the ZIP64 extra field of a central directory record,
+// the fields are the uncompressed size, the compressed size, the local header offset and the disk number.
+func zip64Field(record []byte, field int) ([]byte, error) {
+	nameLen := int(binary.LittleEndian.Uint16(record[28:]))
+	extra := record[zipCentralDirLen+nameLen : zipCentralDirLen+nameLen+int(binary.LittleEndian.Uint16(record[30:]))]
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if id != zip64ExtraID {
+			extra = extra[4+size:]
+			continue
+		}
+
+		data := extra[4 : 4+size]
+		// Only the fields which do not fit into the record are present in the extra field.
+		fields := []struct {
+			present bool
+			size    int
+		}{
+			{binary.LittleEndian.Uint32(record[24:]) == uint32max, 8},
+			{binary.LittleEndian.Uint32(record[20:]) == uint32max, 8},
+			{binary.LittleEndian.Uint32(record[42:]) == uint32max, 8},
+			{binary.LittleEndian.Uint16(record[34:]) == uint16max, 4},
+		}
+		for i, f := range fields[:field] {
+			if f.present {
+				if len(data) < f.size {
+					return nil, fmt.Errorf("truncated ZIP64 extra field (%d)", i)
+				}
+				data = data[f.size:]
+			}
+		}
+		if len(data) < fields[field].size {
+			return nil, errors.New("truncated ZIP64 extra field")
+		}
+		return data[:fields[field].size], nil
+	}
+	return nil, errors.New("missing ZIP64 extra field")
+}
+
+const zip64OffsetField = 2
+
+func centralDirRecordOffset(record []byte) (int64, error) {
+	offset := binary.LittleEndian.Uint32(record[42:])
+	if offset != uint32max {
+		return int64(offset), nil
+	}
+	field, err := zip64Field(record, zip64OffsetField)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(field)), nil
+}
+
+// setCentralDirRecordPosition points the central directory record to the local header on the given volume.
+func setCentralDirRecordPosition(record []byte, disk int, offset int64) error {
+	if binary.LittleEndian.Uint16(record[34:]) == uint16max {
+		return errors.New("unsupported ZIP64 disk number")
+	}
+	binary.LittleEndian.PutUint16(record[34:], uint16(disk))
+
+	if binary.LittleEndian.Uint32(record[42:]) != uint32max {
+		binary.LittleEndian.PutUint32(record[42:], uint32(offset))
+		return nil
+	}
+	field, err := zip64Field(record, zip64OffsetField)
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(field, uint64(offset))
+	return nil
+}
+
+// partsManifest describes how to reassemble an archive split into byte chunks.
+type partsManifest struct {
+	Archive    string         `json:"archive"`
+	Size       int64          `json:"size"`
+	SHA256     string         `json:"sha256"`
+	Parts      []partManifest `json:"parts"`
+	Reassemble string         `json:"reassemble"`
+}
+
+type partManifest struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// writePartsManifest writes the reassembly manifest of the chunks next to them and returns its path.
+func writePartsManifest(archivePth string, archiveSHA256 string, parts []archivePart) (string, error) {
+	manifest := partsManifest{Archive: filepath.Base(archivePth), SHA256: archiveSHA256}
+	var names []string
+	for _, part := range parts {
+		manifest.Size += part.size
+		manifest.Parts = append(manifest.Parts, partManifest{
+			Path:   filepath.Base(part.pth),
+			Size:   part.size,
+			SHA256: part.sha256,
+		})
+		names = append(names, filepath.Base(part.pth))
+	}
+	manifest.Reassemble = fmt.Sprintf("cat %s > %s", strings.Join(names, " "), manifest.Archive)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	pth := archivePth + ".parts.json"
+	if err := os.WriteFile(pth, append(data, '\n'), 0644); err != nil {
+		return "", err
+	}
+	return pth, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// symlinkMode is the way symlinks found in the sources are archived.
+type symlinkMode string
+
+const (
+	// symlinkPreserve stores the symlinks as symlinks.
+	symlinkPreserve symlinkMode = "preserve"
+	// symlinkFollow stores the files and directories the symlinks are pointing to.
+	symlinkFollow symlinkMode = "follow"
+	// symlinkSkip leaves the symlinks out of the archive.
+	symlinkSkip symlinkMode = "skip"
+	// symlinkFollowWithinSource follows the symlinks pointing inside the source directory, any other symlink is an error.
+	symlinkFollowWithinSource symlinkMode = "follow-within-source"
+)
+
+func parseSymlinkMode(mode string) (symlinkMode, error) {
+	switch m := symlinkMode(mode); m {
+	case symlinkPreserve, symlinkFollow, symlinkSkip, symlinkFollowWithinSource:
+		return m, nil
+	case "":
+		return symlinkPreserve, nil
+	default:
+		return "", fmt.Errorf("invalid symlink mode (%s)", mode)
+	}
+}
+
+func (m symlinkMode) follows() bool {
+	return m == symlinkFollow || m == symlinkFollowWithinSource
+}
+
+// symlinkWalker walks a source like filepath.Walk, handling the symlinks according to the mode.
+// A followed symlink is reported with its own path and the file info of its target.
+type symlinkWalker struct {
+	mode symlinkMode
+	// root is the resolved source directory, the followed symlinks have to point inside it.
+	// Empty if the symlinks can point anywhere.
+	root string
+	// skipped is the number of symlinks left out in skip mode.
+	skipped int
+}
+
+func newSymlinkWalker(mode symlinkMode) *symlinkWalker {
+	return &symlinkWalker{mode: mode}
+}
+
+// walk calls fn for the source and every file and directory in it, in lexical order.
+// If fn returns filepath.SkipDir for a directory, its contents are skipped.
+func (w *symlinkWalker) walk(source string, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	w.root = ""
+	if w.mode == symlinkFollowWithinSource {
+		if target, err := os.Stat(source); err == nil && target.IsDir() {
+			if w.root, err = resolvePath(source); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = w.walkPath(source, info, nil, fn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkPath walks pth, parents lists the resolved paths of the directories containing it, to detect symlink loops.
+func (w *symlinkWalker) walkPath(pth string, info os.FileInfo, parents []string, fn filepath.WalkFunc) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch {
+		case w.mode == symlinkSkip:
+			w.skipped++
+			return nil
+		case w.mode.follows():
+			var err error
+			if info, err = w.follow(pth); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fn(pth, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+
+	if w.mode.follows() {
+		resolved, err := resolvePath(pth)
+		if err != nil {
+			return err
+		}
+		for _, parent := range parents {
+			if parent == resolved {
+				return fmt.Errorf("symlink loop: %s points to %s, which contains it", pth, resolved)
+			}
+		}
+		parents = append(parents, resolved)
+	}
+
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(-1)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := filepath.Join(pth, name)
+		info, err := os.Lstat(child)
+		if err != nil {
+			return err
+		}
+		if err := w.walkPath(child, info, parents, fn); err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+	return nil
+}
+
+// follow returns the file info of the symlink's target, checking that the target is inside the root.
+func (w *symlinkWalker) follow(pth string) (os.FileInfo, error) {
+	target, err := resolvePath(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to follow symlink (%s): %s", pth, err)
+	}
+	if w.root != "" {
+		rel, err := filepath.Rel(w.root, target)
+		if err != nil || !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("symlink (%s) points to %s, outside of the source directory (%s)", pth, target, w.root)
+		}
+	}
+	return os.Stat(pth)
+}
+
+// resolvePath returns the absolute path of pth with every symlink resolved.
+func resolvePath(pth string) (string, error) {
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(abs)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// tarArchive writes entries to a tarball, optionally compressed.
+type tarArchive struct {
+	w          *tar.Writer
+	compressor io.WriteCloser
+	hashFiles  bool
+	progress   *progressReporter
+}
+
+// newTarArchive returns a tar writer for the format.
+func newTarArchive(out io.Writer, opts archiveOptions, progress *progressReporter) (*tarArchive, error) {
+	level := opts.levels.level
+	hashFiles := opts.manifestFormat != ""
+
+	var compressor io.WriteCloser
+	var err error
+	switch format := opts.format; format {
+	case formatTar:
+	case formatTarGz:
+		compressor, err = gzip.NewWriterLevel(out, level)
+	case formatTarZst:
+		// zstd has no store only level, 1 is the fastest.
+		if level == 0 {
+			level = 1
+		}
+		concurrency := 1
+		if !opts.reproducible && opts.parallelism > 1 {
+			concurrency = opts.parallelism
+		}
+		compressor, err = zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(concurrency))
+	case formatTarXz:
+		compressor, err = xz.WriterConfig{DictCap: xzDictCap(level)}.NewWriter(out)
+	default:
+		return nil, fmt.Errorf("unsupported tar format (%s)", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if compressor == nil {
+		return &tarArchive{w: tar.NewWriter(out), hashFiles: hashFiles, progress: progress}, nil
+	}
+	return &tarArchive{w: tar.NewWriter(compressor), compressor: compressor, hashFiles: hashFiles, progress: progress}, nil
+}
+
+// xzDictCap returns the dictionary size of the xz preset of the compression level,
+// a larger dictionary finds more repetitions at the cost of memory.
+func xzDictCap(level int) int {
+	switch {
+	case level <= 0:
+		return 256 << 10
+	case level <= 2:
+		return 1 << (level + 19)
+	case level <= 4:
+		return 4 << 20
+	case level <= 6:
+		return 8 << 20
+	default:
+		return 1 << (level + 17)
+	}
+}
+
+// prepare does nothing, the entries of a tarball are compressed together as a single stream.
+func (a *tarArchive) prepare(entries []archiveEntry) error {
+	return nil
+}
+
+func (a *tarArchive) close() error {
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
+
+// add writes a single file, directory or symlink to the archive, keeping its permissions and ownership.
+// Symlinks are stored as symlinks, the file which the symlink is pointing to is not copied.
+func (a *tarArchive) add(entry archiveEntry) (*manifestRecord, error) {
+	var link string
+	switch mode := entry.info.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(entry.pth)
+		if err != nil {
+			return nil, err
+		}
+		link = target
+	case mode.IsDir(), mode.IsRegular():
+	default:
+		log.Warnf("Skipping %s: unsupported file type (%s)", entry.pth, mode.Type())
+		return nil, nil
+	}
+
+	header, err := tar.FileInfoHeader(entry.info, link)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = entry.name
+	if entry.info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := a.w.WriteHeader(header); err != nil {
+		return nil, err
+	}
+
+	record := newManifestRecord(entry.name, entry.info.Mode(), 0, entry.info.ModTime())
+	record.SymlinkTarget = link
+	if entry.info.Mode().IsRegular() {
+		hasher := newContentHasher(a.hashFiles)
+		if err := copyFileTo(a.progress.sourceWriter(hasher.writer(a.w)), entry.pth); err != nil {
+			return nil, err
+		}
+		record.Size = entry.info.Size()
+		record.SHA256 = hasher.sum()
+	}
+
+	return record, nil
+}
+
+// addData writes a regular file with the given content to the archive.
+func (a *tarArchive) addData(name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if err := a.w.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := a.w.Write(data)
+	return err
+}
+
+// testTar decompresses the archive and reads back every entry of it.
+func testTar(pth string, format archiveFormat) error {
+	return readTar(pth, format, func(header *tar.Header, r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+}
+
+// readTar decompresses the archive and calls fn for every entry of it.
+// The whole compressed stream is read, so that the decompressor validates it.
+func readTar(pth string, format archiveFormat, fn func(header *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open archive (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	var r io.Reader = f
+	var decompressor io.ReadCloser
+	switch format {
+	case formatTarGz:
+		decompressor, err = gzip.NewReader(f)
+	case formatTarZst:
+		var d *zstd.Decoder
+		if d, err = zstd.NewReader(f); err == nil {
+			decompressor = d.IOReadCloser()
+		}
+	case formatTarXz:
+		var d *xz.Reader
+		if d, err = xz.NewReader(f); err == nil {
+			decompressor = io.NopCloser(d)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("archive (%s) is corrupt: %s", pth, err)
+	}
+	if decompressor != nil {
+		r = decompressor
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive (%s) is corrupt: %s", pth, err)
+		}
+		if err := fn(header, tr); err != nil {
+			return fmt.Errorf("archive (%s), entry (%s): %s", pth, header.Name, err)
+		}
+	}
+
+	if decompressor != nil {
+		// Drain the trailing padding so that the decompressor validates the whole stream.
+		if _, err := io.Copy(io.Discard, decompressor); err != nil {
+			return fmt.Errorf("archive (%s) is corrupt: %s", pth, err)
+		}
+		if err := decompressor.Close(); err != nil {
+			return fmt.Errorf("archive (%s) is corrupt: %s", pth, err)
+		}
+	}
+
+	return nil
+}
+
+// copyFrom copies the entries of an existing archive of the same format, except the ones listed in skip.
+func (a *tarArchive) copyFrom(pth string, format archiveFormat, skip map[string]bool) ([]manifestRecord, error) {
+	var records []manifestRecord
+	err := readTar(pth, format, func(header *tar.Header, r io.Reader) error {
+		name := strings.TrimSuffix(header.Name, "/")
+		if skip[name] {
+			return nil
+		}
+
+		if err := a.w.WriteHeader(header); err != nil {
+			return err
+		}
+
+		isRegular := header.FileInfo().Mode().IsRegular()
+		hasher := newContentHasher(a.hashFiles && isRegular)
+		if _, err := io.Copy(hasher.writer(a.w), r); err != nil {
+			return err
+		}
+
+		record := newManifestRecord(name, header.FileInfo().Mode(), 0, header.ModTime)
+		if isRegular {
+			record.Size = header.Size
+			record.SHA256 = hasher.sum()
+		}
+		record.SymlinkTarget = header.Linkname
+		records = append(records, *record)
+		return nil
+	})
+	return records, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// unixMetadata controls how the Unix permissions, owner and timestamps of the files are stored in the archive.
+type unixMetadata string
+
+const (
+	// unixPreserve stores the permissions, the owner (UID/GID) and the modification time of the files.
+	unixPreserve unixMetadata = "preserve"
+	// unixNormalize stores 0755 for directories and executables, 0644 for other files and root as the owner.
+	unixNormalize unixMetadata = "normalize"
+	// unixStrip stores no Unix metadata in a ZIP archive, only the MS-DOS attributes and modification time.
+	unixStrip unixMetadata = "strip"
+)
+
+func parseUnixMetadata(metadata string, format archiveFormat) (unixMetadata, error) {
+	switch m := unixMetadata(metadata); m {
+	case unixPreserve, unixNormalize:
+		return m, nil
+	case unixStrip:
+		if format != formatZIP {
+			return "", fmt.Errorf("unix metadata can not be stripped from a %s archive, use normalize instead", format)
+		}
+		return m, nil
+	case "":
+		return unixPreserve, nil
+	default:
+		return "", fmt.Errorf("unsupported unix metadata option (%s)", metadata)
+	}
+}
+
+// normalizeUnixMetadata hides the permissions beyond the executable bit and the owner of the entries,
+// their modification time is kept.
+func normalizeUnixMetadata(entries []archiveEntry) []archiveEntry {
+	normalized := make([]archiveEntry, len(entries))
+	for i, entry := range entries {
+		entry.info = normalizedFileInfo{FileInfo: entry.info, modTime: entry.info.ModTime()}
+		normalized[i] = entry
+	}
+	return normalized
+}
+
+// unixOwner is the owner of an archived file.
+type unixOwner struct {
+	uid, gid int
+}
+
+// fileOwner returns the owner of the file described by the FileInfo.Sys value, nil if it is not known.
+func fileOwner(sys interface{}) *unixOwner {
+	stat, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &unixOwner{uid: int(stat.Uid), gid: int(stat.Gid)}
+}
+
+const (
+	// unixOwnerExtraID is the ID of the Info-ZIP new Unix extra field ("ux"), which stores the UID and the GID.
+	unixOwnerExtraID = 0x7875
+
+	zipCreatorUnix  = 3
+	zipCreatorMacOS = 19
+
+	msdosReadOnly = 0x01
+	msdosDir      = 0x10
+)
+
+// unixOwnerExtra returns the Info-ZIP new Unix extra field with 4 byte UID and GID.
+func unixOwnerExtra(owner unixOwner) []byte {
+	buf := make([]byte, 15)
+	binary.LittleEndian.PutUint16(buf[0:], unixOwnerExtraID)
+	binary.LittleEndian.PutUint16(buf[2:], 11)
+	buf[4] = 1 // version
+	buf[5] = 4
+	binary.LittleEndian.PutUint32(buf[6:], uint32(owner.uid))
+	buf[10] = 4
+	binary.LittleEndian.PutUint32(buf[11:], uint32(owner.gid))
+	return buf
+}
+
+// parseUnixOwnerExtra returns the owner stored in the Info-ZIP new Unix extra field, nil if there is no such field.
+func parseUnixOwnerExtra(extra []byte) *unixOwner {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			return nil
+		}
+		field := extra[4 : 4+size]
+		extra = extra[4+size:]
+		if id != unixOwnerExtraID || len(field) < 1 || field[0] != 1 {
+			continue
+		}
+
+		var ids []int
+		field = field[1:]
+		for i := 0; i < 2; i++ {
+			if len(field) < 1 || int(field[0]) > 8 || len(field) < 1+int(field[0]) {
+				return nil
+			}
+			var id uint64
+			for j := int(field[0]); j > 0; j-- {
+				id = id<<8 | uint64(field[j])
+			}
+			ids = append(ids, int(id))
+			field = field[1+int(field[0]):]
+		}
+		return &unixOwner{uid: ids[0], gid: ids[1]}
+	}
+	return nil
+}
+
+// fileHeader returns the ZIP header of the entry, with its Unix metadata stored according to the unix metadata option.
+func (a *zipArchive) fileHeader(entry archiveEntry) (*zip.FileHeader, error) {
+	header, err := zip.FileInfoHeader(entry.info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = entry.name
+	a.setModTime(header, entry.info.ModTime())
+	a.setUnixMetadata(header, entry.info.Sys())
+	return header, nil
+}
+
+// setUnixMetadata adds the owner extra field to the header, or strips the Unix permissions from it.
+// No owner extra field is added in reproducible mode.
+// sys is the FileInfo.Sys value of the file, the owner is added only if it is known.
+func (a *zipArchive) setUnixMetadata(header *zip.FileHeader, sys interface{}) {
+	switch a.unixMetadata {
+	case unixStrip:
+		// Symlinks keep their Unix attributes, without them the link would be extracted as a regular file.
+		if header.Mode()&os.ModeSymlink != 0 {
+			return
+		}
+		mode := header.Mode()
+		header.CreatorVersion &= 0xff
+		header.ExternalAttrs = 0
+		if mode.IsDir() {
+			header.ExternalAttrs |= msdosDir
+		}
+		if mode&0200 == 0 {
+			header.ExternalAttrs |= msdosReadOnly
+		}
+	case unixNormalize:
+		// Reproducible archives have no extra fields.
+		if !a.reproducible {
+			header.Extra = append(header.Extra, unixOwnerExtra(unixOwner{})...)
+		}
+	default:
+		if owner := fileOwner(sys); owner != nil {
+			header.Extra = append(header.Extra, unixOwnerExtra(*owner)...)
+		}
+	}
+}
+
+// zipEntryMode returns the mode of the ZIP entry. The entries written without Unix attributes
+// get 0755 for directories and 0644 for files, 0444 if they are read-only.
+func zipEntryMode(f *zip.File) os.FileMode {
+	if creator := f.CreatorVersion >> 8; creator == zipCreatorUnix || creator == zipCreatorMacOS {
+		return f.Mode()
+	}
+	switch mode := f.Mode(); {
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&0200 == 0:
+		return 0444
+	default:
+		return 0644
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// verifyReport lists the entries of a verified archive and the problems found.
+type verifyReport struct {
+	entries []verifiedEntry
+	corrupt []string
+	missing []string
+	// zip64 is true if the ZIP archive uses the ZIP64 records.
+	zip64 bool
+}
+
+type verifiedEntry struct {
+	name string
+	mode os.FileMode
+	size int64
+}
+
+func (r verifyReport) failed() bool {
+	return len(r.corrupt) > 0 || len(r.missing) > 0
+}
+
+// String returns the list of the corrupt entries and the missing paths.
+func (r verifyReport) String() string {
+	var lines []string
+	if len(r.corrupt) > 0 {
+		lines = append(lines, fmt.Sprintf("%d corrupt entries:", len(r.corrupt)))
+		for _, problem := range r.corrupt {
+			lines = append(lines, "- "+problem)
+		}
+	}
+	if len(r.missing) > 0 {
+		lines = append(lines, fmt.Sprintf("%d required paths are missing:", len(r.missing)))
+		for _, pth := range r.missing {
+			lines = append(lines, "- "+pth)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// verify checks the integrity of the archive given as the source path and that it contains the required paths,
+// then exports the outputs.
+func verify(cfg config) error {
+	sources := splitList(cfg.SourcePath)
+	if len(sources) != 1 {
+		return fmt.Errorf("exactly one archive has to be given as the source path in verify mode, got %d", len(sources))
+	}
+	archivePth := sources[0]
+	if err := checkArchiveIsFile(archivePth); err != nil {
+		return err
+	}
+
+	fallback, err := parseArchiveFormat(cfg.ArchiveFormat)
+	if err != nil {
+		return err
+	}
+	format := detectArchiveFormat(archivePth, fallback)
+
+	log.Printf("")
+	log.Infof("Verifying %s (%s)", archivePth, format)
+
+	report, err := verifyArchive(archivePth, format, string(cfg.EncryptionPassword))
+	if err != nil {
+		return err
+	}
+	report.missing = missingPaths(report.entries, splitList(cfg.RequiredPaths))
+
+	for _, entry := range report.entries {
+		log.Printf("%s %10d %s", entry.mode, entry.size, entry.name)
+	}
+	log.Printf("%d entries", len(report.entries))
+	if report.zip64 {
+		log.Printf("The archive uses ZIP64 records")
+	}
+
+	if report.failed() {
+		return fmt.Errorf("archive (%s) failed verification\n%s", archivePth, report)
+	}
+	log.Donef("Every entry is intact and every required path is present")
+
+	pth, err := filepath.Abs(archivePth)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("")
+	log.Infof("Exporting outputs")
+
+	outputs := []struct{ key, value string }{
+		{"BITRISE_ZIP_PATH", pth},
+		{"BITRISE_ZIP_ENTRY_COUNT", strconv.Itoa(len(report.entries))},
+	}
+	if format == formatZIP {
+		outputs = append(outputs, struct{ key, value string }{"BITRISE_ZIP_ZIP64", strconv.FormatBool(report.zip64)})
+	}
+	for _, output := range outputs {
+		if err := exportEnvironmentWithEnvman(output.key, output.value); err != nil {
+			return fmt.Errorf("failed to export %s: %s", output.key, err)
+		}
+		log.Donef("$%s = %s", output.key, output.value)
+	}
+	return nil
+}
+
+// verifyArchive reads back every entry of the archive. Unlike testArchive, it does not stop at the first corrupt ZIP entry,
+// but reports all of them. A corrupt tarball can not be read past the first error, so only that one is reported.
+func verifyArchive(pth string, format archiveFormat, password string) (verifyReport, error) {
+	if format == formatZIP {
+		return verifyZIP(pth, password)
+	}
+
+	var report verifyReport
+	err := readTar(pth, format, func(header *tar.Header, r io.Reader) error {
+		report.entries = append(report.entries, verifiedEntry{
+			name: strings.TrimSuffix(header.Name, "/"),
+			mode: header.FileInfo().Mode(),
+			size: header.Size,
+		})
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	if err != nil {
+		report.corrupt = append(report.corrupt, err.Error())
+	}
+	return report, nil
+}
+
+func verifyZIP(pth, password string) (verifyReport, error) {
+	r, err := zip.OpenReader(pth)
+	if err != nil {
+		return verifyReport{}, fmt.Errorf("failed to open archive (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	var report verifyReport
+	if report.zip64, err = hasZIP64End(pth); err != nil {
+		return verifyReport{}, fmt.Errorf("failed to read archive (%s): %s", pth, err)
+	}
+	for _, f := range r.File {
+		if f.CompressedSize == uint32max || f.UncompressedSize == uint32max {
+			report.zip64 = true
+		}
+		report.entries = append(report.entries, verifiedEntry{
+			name: strings.TrimSuffix(f.Name, "/"),
+			mode: f.Mode(),
+			size: int64(f.UncompressedSize64),
+		})
+		if err := testZIPEntry(f, password); err != nil {
+			report.corrupt = append(report.corrupt, fmt.Sprintf("%s: %s", f.Name, err))
+		}
+	}
+	return report, nil
+}
+
+// missingPaths returns the required paths which are not matched by any entry.
+// A required path can be a glob pattern, `**` matches any number of directories.
+func missingPaths(entries []verifiedEntry, required []string) []string {
+	var missing []string
+	for _, pattern := range required {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		found := false
+		for _, entry := range entries {
+			if entry.name == pattern || matchGlob(pattern, entry.name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, pattern)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// zipArchive writes entries to a ZIP archive.
+type zipArchive struct {
+	w            *zip.Writer
+	levels       compressionLevels
+	hashFiles    bool
+	reproducible bool
+	encryption   zipEncryption
+	password     string
+	parallelism  int
+	temps        *tempFiles
+	compressor   *zipCompressor
+	progress     *progressReporter
+	out          *zipOutput
+	zip64        zip64Mode
+	unixMetadata unixMetadata
+}
+
+func newZIPArchive(out io.Writer, opts archiveOptions, temps *tempFiles, progress *progressReporter) *zipArchive {
+	output := &zipOutput{w: out}
+	return &zipArchive{
+		w:            zip.NewWriter(output),
+		levels:       opts.levels,
+		hashFiles:    opts.manifestFormat != "",
+		reproducible: opts.reproducible,
+		encryption:   opts.encryption,
+		password:     opts.password,
+		parallelism:  opts.parallelism,
+		temps:        temps,
+		progress:     progress,
+		out:          output,
+		zip64:        opts.zip64,
+		unixMetadata: opts.unixMetadata,
+	}
+}
+
+// prepare starts compressing the regular files on a pool of workers, if parallelism is enabled.
+// If ZIP64 is disabled, it fails early on the entries which would need it for sure.
+func (a *zipArchive) prepare(entries []archiveEntry) error {
+	if a.zip64 == zip64Disable {
+		if len(entries) >= uint16max {
+			return fmt.Errorf("the archive would have %d entries, which needs ZIP64 records, but ZIP64 is disabled", len(entries))
+		}
+		for _, entry := range entries {
+			if entry.info.Mode().IsRegular() && entry.info.Size() >= uint32max {
+				return fmt.Errorf("%s is larger than 4 GB, which needs ZIP64 records, but ZIP64 is disabled", entry.pth)
+			}
+		}
+	}
+
+	if a.parallelism <= 1 {
+		return nil
+	}
+	a.compressor = newZIPCompressor(a, a.parallelism, a.temps)
+	return a.compressor.start(entries)
+}
+
+// close writes the central directory. Unless ZIP64 is used automatically, the end of the archive is captured
+// to force the ZIP64 records or to check that they are not needed.
+func (a *zipArchive) close() error {
+	if a.compressor != nil {
+		a.compressor.close()
+	}
+	if a.zip64 == zip64Auto {
+		return a.w.Close()
+	}
+
+	if err := a.w.Flush(); err != nil {
+		return err
+	}
+	base := a.out.written
+	a.out.tail = &bytes.Buffer{}
+	if err := a.w.Close(); err != nil {
+		return err
+	}
+	tail := a.out.tail.Bytes()
+	a.out.tail = nil
+
+	if a.zip64 == zip64Force {
+		var err error
+		if tail, err = forceZIP64(tail, base); err != nil {
+			return fmt.Errorf("failed to write ZIP64 records: %s", err)
+		}
+	} else if err := checkNoZIP64(tail, base); err != nil {
+		return err
+	}
+	_, err := a.out.Write(tail)
+	return err
+}
+
+// add writes a single file, directory or symlink to the archive.
+// Symlinks are stored as symlinks, the file which the symlink is pointing to is not copied.
+func (a *zipArchive) add(entry archiveEntry) (*manifestRecord, error) {
+	header, err := a.fileHeader(entry)
+	if err != nil {
+		return nil, err
+	}
+	record := newManifestRecord(entry.name, entry.info.Mode(), 0, entry.info.ModTime())
+
+	switch mode := entry.info.Mode(); {
+	case mode.IsDir():
+		header.Name += "/"
+		header.Method = zip.Store
+		if _, err := a.w.CreateHeader(header); err != nil {
+			return nil, err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(entry.pth)
+		if err != nil {
+			return nil, err
+		}
+
+		header.Method = zip.Store
+		w, err := a.w.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(w, target); err != nil {
+			return nil, err
+		}
+		record.SymlinkTarget = target
+	case mode.IsRegular():
+		if a.compressor != nil {
+			compressed, ok, err := a.compressor.write(entry)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				record.Size = entry.info.Size()
+				record.SHA256 = compressed.sha256
+				break
+			}
+		}
+
+		hasher := newContentHasher(a.hashFiles)
+		if err := a.writeFile(header, func(w io.Writer) error {
+			return copyFileTo(a.progress.sourceWriter(hasher.writer(w)), entry.pth)
+		}); err != nil {
+			return nil, err
+		}
+		record.Size = entry.info.Size()
+		record.SHA256 = hasher.sum()
+	default:
+		log.Warnf("Skipping %s: unsupported file type (%s)", entry.pth, mode.Type())
+		return nil, nil
+	}
+
+	return record, nil
+}
+
+// addData writes a regular file with the given content to the archive.
+func (a *zipArchive) addData(name string, data []byte, modTime time.Time) error {
+	header := &zip.FileHeader{Name: name}
+	header.SetMode(0644)
+	a.setModTime(header, modTime)
+	a.setUnixMetadata(header, nil)
+
+	return a.writeFile(header, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeFile writes a regular file entry with the content written by fn, encrypting it if a password is set.
+func (a *zipArchive) writeFile(header *zip.FileHeader, fn func(w io.Writer) error) error {
+	if a.encryption != encryptionNone {
+		return writeEncryptedZIPEntry(a.w, header, a.levels.levelFor(header.Name), a.password, a.encryption, fn)
+	}
+
+	a.setCompression(header)
+	w, err := a.w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return fn(w)
+}
+
+// copyFrom copies the entries of an existing ZIP archive without recompressing them, except the ones listed in skip.
+func (a *zipArchive) copyFrom(pth string, format archiveFormat, skip map[string]bool) ([]manifestRecord, error) {
+	r, err := zip.OpenReader(pth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	var records []manifestRecord
+	for _, f := range r.File {
+		name := strings.TrimSuffix(f.Name, "/")
+		if skip[name] {
+			continue
+		}
+		if err := a.copyEntry(f); err != nil {
+			return nil, fmt.Errorf("failed to copy %s from %s: %s", f.Name, pth, err)
+		}
+
+		record, err := a.copiedRecord(name, f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from %s: %s", f.Name, pth, err)
+		}
+		records = append(records, *record)
+	}
+	return records, nil
+}
+
+// copyEntry copies the entry without decompressing it, like zip.Writer.Copy.
+// The ZIP64 extra field of the entry is dropped, the writer adds a new one if the entry still needs it.
+func (a *zipArchive) copyEntry(f *zip.File) error {
+	r, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	header := f.FileHeader
+	header.Extra = removeZIP64Extra(header.Extra)
+	w, err := a.w.CreateRaw(&header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// copiedRecord describes an entry copied from an existing archive,
+// the content of the entry is read only if it is needed for the manifest.
+func (a *zipArchive) copiedRecord(name string, f *zip.File) (*manifestRecord, error) {
+	mode := f.Mode()
+	record := newManifestRecord(name, mode, 0, f.Modified)
+	if !mode.IsRegular() && mode&os.ModeSymlink == 0 {
+		return record, nil
+	}
+	if mode.IsRegular() && !a.hashFiles {
+		record.Size = int64(f.UncompressedSize64)
+		return record, nil
+	}
+
+	rc, err := openZIPEntry(f, a.password)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", f.Name, err)
+		}
+	}()
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, err
+		}
+		record.SymlinkTarget = string(target)
+		return record, nil
+	}
+
+	hasher := newContentHasher(true)
+	size, err := io.Copy(hasher.writer(io.Discard), rc)
+	if err != nil {
+		return nil, err
+	}
+	record.Size = size
+	record.SHA256 = hasher.sum()
+	return record, nil
+}
+
+// setModTime sets the modification time of the header. In reproducible mode only the MS-DOS time fields are set,
+// so no extended timestamp extra field is written, which would store the time zone dependent Unix time.
+// The extended timestamp is not written either if the Unix metadata is stripped.
+func (a *zipArchive) setModTime(header *zip.FileHeader, modTime time.Time) {
+	if a.reproducible || a.unixMetadata == unixStrip {
+		header.ModifiedDate, header.ModifiedTime = msDOSDateTime(modTime)
+		header.Modified = time.Time{}
+		return
+	}
+	header.Modified = modTime
+}
+
+// setCompression sets the compression method of the header and registers a deflate compressor
+// with the compression level belonging to the entry. Level 0 stores the entry without compression.
+func (a *zipArchive) setCompression(header *zip.FileHeader) {
+	level := a.levels.levelFor(header.Name)
+	if level == 0 {
+		header.Method = zip.Store
+		return
+	}
+
+	header.Method = zip.Deflate
+	a.w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+}
+
+func copyFileTo(w io.Writer, pth string) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// testZIP reads back every entry of the archive, which verifies the CRC-32 checksums
+// and the authentication codes of the AES encrypted entries.
+func testZIP(pth, password string) error {
+	r, err := zip.OpenReader(pth)
+	if err != nil {
+		return fmt.Errorf("failed to open archive (%s): %s", pth, err)
+	}
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	for _, f := range r.File {
+		if err := testZIPEntry(f, password); err != nil {
+			return fmt.Errorf("archive (%s) is corrupt, entry (%s): %s", pth, f.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func testZIPEntry(f *zip.File, password string) error {
+	rc, err := openZIPEntry(f, password)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := rc.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", f.Name, err)
+		}
+	}()
+
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// zip64Mode controls when the ZIP64 extensions are used.
+type zip64Mode string
+
+const (
+	// zip64Auto uses the ZIP64 records only if the archive or an entry exceeds the limits of the ZIP format:
+	// 4 GB for the sizes and offsets, 65,535 for the number of entries.
+	zip64Auto zip64Mode = "auto"
+	// zip64Force uses the ZIP64 records for every entry and for the end of the central directory.
+	zip64Force zip64Mode = "force"
+	// zip64Disable fails if the archive would need the ZIP64 records.
+	zip64Disable zip64Mode = "disable"
+)
+
+func parseZIP64Mode(force, disable bool) (zip64Mode, error) {
+	switch {
+	case force && disable:
+		return "", errors.New("ZIP64 can not be forced and disabled at the same time")
+	case force:
+		return zip64Force, nil
+	case disable:
+		return zip64Disable, nil
+	default:
+		return zip64Auto, nil
+	}
+}
+
+// zipOutput is the writer under the zip.Writer, it can capture the end of the archive,
+// so that the central directory can be rewritten before it reaches the output.
+type zipOutput struct {
+	w       io.Writer
+	written int64
+	tail    *bytes.Buffer
+}
+
+func (o *zipOutput) Write(p []byte) (int, error) {
+	if o.tail != nil {
+		return o.tail.Write(p)
+	}
+	n, err := o.w.Write(p)
+	o.written += int64(n)
+	return n, err
+}
+
+// tailReader reads the captured end of the archive at the offsets of the whole archive.
+type tailReader struct {
+	tail []byte
+	base int64
+}
+
+func (r tailReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < r.base || off-r.base > int64(len(r.tail)) {
+		return 0, errors.New("offset out of the captured end of the archive")
+	}
+	n := copy(p, r.tail[off-r.base:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// centralDirectory returns the central directory records and the end of the archive from the captured tail,
+// which starts at the base offset of the archive.
+func centralDirectory(tail []byte, base int64) ([][]byte, zipEnd, error) {
+	end, err := readZIPEnd(tailReader{tail: tail, base: base}, base, base+int64(len(tail)))
+	if err != nil {
+		return nil, zipEnd{}, err
+	}
+	start := end.cdOffset - base
+	if start < 0 || start+end.cdSize > int64(len(tail)) {
+		return nil, zipEnd{}, errors.New("central directory is not at the end of the archive")
+	}
+	records, err := splitCentralDirectory(tail[start:start+end.cdSize], end.entries)
+	if err != nil {
+		return nil, zipEnd{}, err
+	}
+	return records, end, nil
+}
+
+// forceZIP64 rewrites the central directory in the captured tail with ZIP64 extra fields in every record,
+// followed by the ZIP64 end of central directory record and locator.
+// The local headers are left as they are, their sizes are in the data descriptors.
+func forceZIP64(tail []byte, base int64) ([]byte, error) {
+	records, end, err := centralDirectory(tail, base)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(bytes.Clone(tail[:end.cdOffset-base]))
+	for _, record := range records {
+		record, err := zip64CentralDirRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(record)
+	}
+	cdSize := int64(out.Len()) - (end.cdOffset - base)
+	zip64EOCDOffset := end.cdOffset + cdSize
+
+	zip64EOCD := make([]byte, zip64EOCDLen)
+	binary.LittleEndian.PutUint32(zip64EOCD[0:], zip64EOCDSignature)
+	binary.LittleEndian.PutUint64(zip64EOCD[4:], zip64EOCDLen-12)
+	binary.LittleEndian.PutUint16(zip64EOCD[12:], zipVersion45)
+	binary.LittleEndian.PutUint16(zip64EOCD[14:], zipVersion45)
+	binary.LittleEndian.PutUint64(zip64EOCD[24:], uint64(len(records)))
+	binary.LittleEndian.PutUint64(zip64EOCD[32:], uint64(len(records)))
+	binary.LittleEndian.PutUint64(zip64EOCD[40:], uint64(cdSize))
+	binary.LittleEndian.PutUint64(zip64EOCD[48:], uint64(end.cdOffset))
+	out.Write(zip64EOCD)
+
+	locator := make([]byte, zip64LocatorLen)
+	binary.LittleEndian.PutUint32(locator[0:], zip64LocatorSignature)
+	binary.LittleEndian.PutUint64(locator[8:], uint64(zip64EOCDOffset))
+	binary.LittleEndian.PutUint32(locator[16:], 1)
+	out.Write(locator)
+
+	// The fields of the end of central directory record are stored in the ZIP64 record only.
+	eocd := bytes.Clone(end.eocd)
+	binary.LittleEndian.PutUint16(eocd[8:], uint16max)
+	binary.LittleEndian.PutUint16(eocd[10:], uint16max)
+	binary.LittleEndian.PutUint32(eocd[12:], uint32max)
+	binary.LittleEndian.PutUint32(eocd[16:], uint32max)
+	out.Write(eocd)
+
+	return out.Bytes(), nil
+}
+
+// zip64CentralDirRecord returns the record with the sizes and the local header offset moved to a ZIP64 extra field.
+func zip64CentralDirRecord(record []byte) ([]byte, error) {
+	var values [3]uint64
+	for i, pos := range []int{24, 20, 42} {
+		value := uint64(binary.LittleEndian.Uint32(record[pos:]))
+		if value == uint32max {
+			field, err := zip64Field(record, i)
+			if err != nil {
+				return nil, err
+			}
+			value = binary.LittleEndian.Uint64(field)
+		}
+		values[i] = value
+	}
+
+	nameLen := int(binary.LittleEndian.Uint16(record[28:]))
+	extraLen := int(binary.LittleEndian.Uint16(record[30:]))
+	name := record[zipCentralDirLen : zipCentralDirLen+nameLen]
+	extra := record[zipCentralDirLen+nameLen : zipCentralDirLen+nameLen+extraLen]
+	comment := record[zipCentralDirLen+nameLen+extraLen:]
+
+	zip64Extra := make([]byte, 28)
+	binary.LittleEndian.PutUint16(zip64Extra[0:], zip64ExtraID)
+	binary.LittleEndian.PutUint16(zip64Extra[2:], 24)
+	for i, value := range values {
+		binary.LittleEndian.PutUint64(zip64Extra[4+8*i:], value)
+	}
+	extra = append(removeZIP64Extra(extra), zip64Extra...)
+	if len(extra) > uint16max {
+		return nil, fmt.Errorf("extra fields of %s are too long", name)
+	}
+
+	rewritten := bytes.Clone(record[:zipCentralDirLen])
+	binary.LittleEndian.PutUint16(rewritten[6:], max(binary.LittleEndian.Uint16(rewritten[6:]), zipVersion45))
+	binary.LittleEndian.PutUint32(rewritten[20:], uint32max)
+	binary.LittleEndian.PutUint32(rewritten[24:], uint32max)
+	binary.LittleEndian.PutUint16(rewritten[30:], uint16(len(extra)))
+	binary.LittleEndian.PutUint32(rewritten[42:], uint32max)
+	rewritten = append(rewritten, name...)
+	rewritten = append(rewritten, extra...)
+	return append(rewritten, comment...), nil
+}
+
+// checkNoZIP64 returns an error if the archive in the captured tail uses the ZIP64 records.
+func checkNoZIP64(tail []byte, base int64) error {
+	records, end, err := centralDirectory(tail, base)
+	if err != nil {
+		return err
+	}
+	if end.zip64EOCD != nil {
+		if end.entries >= uint16max {
+			return fmt.Errorf("the archive has %d entries, which needs ZIP64 records, but ZIP64 is disabled", end.entries)
+		}
+		return errors.New("the archive is larger than 4 GB, which needs ZIP64 records, but ZIP64 is disabled")
+	}
+	for _, record := range records {
+		if binary.LittleEndian.Uint32(record[20:]) == uint32max || binary.LittleEndian.Uint32(record[24:]) == uint32max || binary.LittleEndian.Uint32(record[42:]) == uint32max {
+			name := record[zipCentralDirLen : zipCentralDirLen+int(binary.LittleEndian.Uint16(record[28:]))]
+			return fmt.Errorf("%s is larger than 4 GB or starts after 4 GB in the archive, which needs ZIP64 records, but ZIP64 is disabled", name)
+		}
+	}
+	return nil
+}
+
+// removeZIP64Extra returns the extra fields without the ZIP64 one, the writer adds it back if needed.
+func removeZIP64Extra(extra []byte) []byte {
+	var kept []byte
+	for len(extra) >= 4 {
+		size := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < size {
+			break
+		}
+		if binary.LittleEndian.Uint16(extra) != zip64ExtraID {
+			kept = append(kept, extra[:size]...)
+		}
+		extra = extra[size:]
+	}
+	return kept
+}
+
+// hasZIP64End reports whether the ZIP archive at pth has a ZIP64 end of central directory record.
+func hasZIP64End(pth string) (bool, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	end, err := readZIPEnd(f, 0, info.Size())
+	if err != nil {
+		return false, err
+	}
+	return end.zip64EOCD != nil, nil
+}